@@ -27,6 +27,31 @@ func timeIt(text string, tf timeableFunc) {
 	log.Info("<%0.2f ms> %s", float64(elapsed.Nanoseconds())/1000000.0, text)
 }
 
+// timingTracer logs how long each of Marshal's coordination operations takes.
+type timingTracer struct{}
+
+type timingSpan struct {
+	operation string
+	keyvals   []interface{}
+	start     time.Time
+}
+
+func (timingTracer) StartSpan(operation string, keyvals ...interface{}) marshal.Span {
+	return &timingSpan{operation: operation, keyvals: keyvals, start: time.Now()}
+}
+
+func (s *timingSpan) Event(name string, keyvals ...interface{}) {
+	log.Info("<%0.2f ms> %s: %s", msSince(s.start), s.operation, name)
+}
+
+func (s *timingSpan) End(err error) {
+	log.Info("<%0.2f ms> %s %v (err: %v)", msSince(s.start), s.operation, s.keyvals, err)
+}
+
+func msSince(start time.Time) float64 {
+	return float64(time.Now().Sub(start).Nanoseconds()) / 1000000.0
+}
+
 func main() {
 	broker := flag.String("broker", "localhost:9092", "ip:port of a single broker")
 	group := flag.String("group", "debug-group", "group ID to use")
@@ -36,6 +61,7 @@ func main() {
 	greedyClaim := flag.Bool("greedy-claim", false, "turn on greedy claims")
 	fastReclaim := flag.Bool("fast-reclaim", false, "enable fast reclaim mode")
 	printOnly := flag.Bool("print-state-only", false, "only print state, do not claim")
+	traceOps := flag.Bool("trace", false, "time every coordination operation")
 	flag.Parse()
 
 	// Raise marshal debugging level
@@ -45,7 +71,15 @@ func main() {
 	var m *marshal.Marshaler
 	timeIt("construct Marshaler", func() {
 		var err error
-		m, err = marshal.NewMarshaler(*client, *group, []string{*broker})
+		options := marshal.NewMarshalOptions()
+		if *traceOps {
+			options.Tracer = timingTracer{}
+		}
+		cluster, err := marshal.Dial("debug", []string{*broker}, options)
+		if err != nil {
+			log.Fatalf("Failed to connect to Kafka: %s", err)
+		}
+		m, err = cluster.NewMarshaler(*client, *group)
 		if err != nil {
 			log.Fatalf("Failed to construct Marshaler: %s", err)
 		}
@@ -102,11 +102,16 @@ func (m *Marshaler) NewAdmin(groupID string, pauseTimeout time.Duration) (Admin,
 	}, nil
 }
 
+// logFields returns the fields identifying this Admin in log messages, followed by keyvals.
+func (a *consumerGroupAdmin) logFields(keyvals ...interface{}) []interface{} {
+	return append([]interface{}{"group", a.groupID, "client", a.clientID}, keyvals...)
+}
+
 // release releases an Admin's claim on a partition. Optionally resets the offset on the partition.
 func (a consumerGroupAdmin) release(topic string, partID int, offset int64) bool {
 	if err := a.marshaler.ReleasePartition(topic, partID, offset); err != nil {
-		log.Errorf("[%s:%d] Admin failed to release partition with offset %d: %s",
-			topic, partID, offset, err)
+		log.Error("admin failed to release partition",
+			partitionFields(a.marshaler, topic, partID, "offset", offset, "err", err)...)
 		return false
 	}
 
@@ -119,7 +124,7 @@ func (a *consumerGroupAdmin) releaseClaims(resetOffset bool) error {
 	defer a.lock.RUnlock()
 
 	if !resetOffset {
-		log.Infof("Admin releasing claims without resetting offsets.")
+		log.Info("admin releasing claims without resetting offsets", a.logFields()...)
 	}
 
 	fail := make(chan bool)
@@ -162,8 +167,8 @@ func (a *consumerGroupAdmin) heartbeat(topic string, partID int, offset int64) b
 	// If we fail to heartbeat, record this in claimHealth.
 	// The Admin will take care of cleaning up other claims.
 	if err := a.marshaler.Heartbeat(topic, partID, offset); err != nil {
-		log.Errorf("[%s:%d] Admin failed to heartbeat. It is now unhealthy "+
-			"and will not reset offsets.", topic, partID)
+		log.Error("admin failed to heartbeat, it is now unhealthy and will not reset offsets",
+			partitionFields(a.marshaler, topic, partID, "err", err)...)
 		atomic.StoreInt32(a.claimHealth, 0)
 		return false
 	}
@@ -214,8 +219,8 @@ func (a *consumerGroupAdmin) claimAndHeartbeat(
 
 	// Next, try to claim the partition.
 	if !a.marshaler.ClaimPartition(topic, partID) {
-		log.Errorf("[%s:%d] Admin couldn't claim partition to set Kafka offset",
-			topic, partID)
+		log.Error("admin couldn't claim partition to set Kafka offset",
+			partitionFields(a.marshaler, topic, partID)...)
 		// It's necessary to call heartbeatsWg.Done() directly because the heartbeatLoop goroutine
 		// will not be launched in this case.
 		heartbeatsWg.Done()
@@ -267,8 +272,8 @@ func (a *consumerGroupAdmin) sendReleaseGroupMessage(topicName string, partID in
 // then attempts to claim it.
 func (a *consumerGroupAdmin) pauseGroupAndWaitForRelease(topicName string, partID int) bool {
 	if err := a.sendReleaseGroupMessage(topicName, partID); err != nil {
-		log.Errorf("[%s:%d] Admin failed to produce ReleaseMessage group to Kafka: %s",
-			topicName, partID, err)
+		log.Error("admin failed to produce ReleaseGroup message to Kafka",
+			partitionFields(a.marshaler, topicName, partID, "err", err)...)
 		return false
 	}
 
@@ -292,7 +297,18 @@ func (a *consumerGroupAdmin) pauseGroupAndWaitForRelease(topicName string, partI
 func (a *consumerGroupAdmin) SetConsumerGroupPosition(groupID string,
 	offsets map[string]map[int]int64) error {
 
-	log.Infof("Admin %s going to pause consumer group %s", a.clientID, groupID)
+	span := a.marshaler.cluster.startSpan(TraceSetConsumerGroupPosition,
+		"group", groupID, "client", a.clientID, "topics", len(offsets))
+	err := a.setConsumerGroupPosition(span, groupID, offsets)
+	span.End(err)
+	return err
+}
+
+// setConsumerGroupPosition is SetConsumerGroupPosition, marking its phases on span.
+func (a *consumerGroupAdmin) setConsumerGroupPosition(span Span, groupID string,
+	offsets map[string]map[int]int64) error {
+
+	log.Info("admin going to pause consumer group", a.logFields("paused_group", groupID)...)
 	var wg sync.WaitGroup
 	// Send out a ReleaseGroup message to Marshal for each partition we want to set the position for,
 	// then wait for all the partitions to be released.
@@ -324,8 +340,10 @@ func (a *consumerGroupAdmin) SetConsumerGroupPosition(groupID string,
 		break
 	}
 
+	span.Event("group_paused")
+
 	// Attempt to claim the now-released partitions, then heartbeat old offsets after a successful claim.
-	log.Infof("Admin now claiming released partitions.")
+	log.Info("admin now claiming released partitions", a.logFields()...)
 	claimFailures := make(chan bool)
 	defer close(claimFailures)
 
@@ -369,6 +387,7 @@ func (a *consumerGroupAdmin) SetConsumerGroupPosition(groupID string,
 		a.releaseClaims(false)
 		return err
 	case <-claimsDone:
+		span.Event("partitions_claimed")
 		close(stopHeartbeats)
 
 		// It's critical that we don't perform an offset-resetting release operation until
@@ -9,7 +9,9 @@
 package marshal
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"sort"
 	"sync"
@@ -28,6 +30,43 @@ func (a int64slice) Len() int           { return len(a) }
 func (a int64slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a int64slice) Less(i, j int) bool { return a[i] < a[j] }
 
+// pausePollInterval is how often a paused messagePump checks whether it has been resumed.
+const pausePollInterval = 100 * time.Millisecond
+
+// claimSequence numbers the claims made by this process, see claim.id.
+var claimSequence int64
+
+// anyEpoch can be passed to commit to skip checking which epoch a message came from.
+const anyEpoch = -1
+
+// seekRequest is how Seek asks the messagePump to move the claim to a new offset.
+type seekRequest struct {
+	offset int64
+	done   chan error
+}
+
+// delivery records what we know about an outstanding offset that has been handed to the
+// client.
+type delivery struct {
+	// attempts is how many times this offset has been put on the messages channel.
+	attempts int
+
+	// queuedAt is when we first read this offset from Kafka.
+	queuedAt time.Time
+
+	// deliveredAt is when the offset was last put on the messages channel. This is zero
+	// while the offset is waiting to be redelivered after a Nack.
+	deliveredAt time.Time
+
+	// retrying is set from the moment a Nack (or the visibility timeout) schedules a
+	// redelivery until the redelivery happens, so the same delivery can't be retried twice.
+	retrying bool
+
+	// msg is the last message delivered for this offset. It is only retained when a
+	// VisibilityTimeout is configured, since otherwise we never redeliver on our own.
+	msg *Message
+}
+
 // claim is instantiated for each partition "claim" we have. This type is responsible for
 // pulling data from Kafka and managing its cursors, heartbeating as necessary, and health
 // checking itself.
@@ -37,24 +76,43 @@ type claim struct {
 	topic  string
 	partID int
 
+	// id identifies this claim, as distinct from any other claim of the same partition
+	// by us or anybody else.
+	id string
+
 	// lock protects all access to the member variables of this struct except for the
 	// messages channel, which can be read from or written to without holding the lock.
-	// Additionally the stopChan can be used.
+	// Additionally the stopChan can be used. The messages channel is this claim's own
+	// buffer which the consumer drains into the ConsumeChannel; every message in it holds
+	// a slot in queueSlots and its size in queueBytes, the consumer-wide budgets (nil if
+	// we have no consumer).
 	lock            *sync.RWMutex
 	messagesLock    *sync.Mutex
+	storeLock       *sync.Mutex
 	offsets         PartitionOffsets
 	marshal         *Marshaler
 	consumer        *Consumer
 	rand            *rand.Rand
 	terminated      *int32
+	paused          *int32
 	beatCounter     int32
 	lastHeartbeat   int64
 	lastMessageTime time.Time
 	options         ConsumerOptions
+	offsetSource    string
 	kafkaConsumer   kafka.Consumer
 	messages        chan *Message
+	queueSlots      chan struct{}
+	queueBytes      *queueBudget
+	limiter         *rateLimiter
 	stopChan        chan struct{}
 	doneChan        chan struct{}
+	seekChan        chan seekRequest
+
+	// epoch is incremented every time the claim is moved to a new offset. Messages are
+	// stamped with the epoch they were read in so that stale messages can't be committed
+	// against the tracking state of the new position.
+	epoch int
 
 	// tracking is a dict that maintains information about offsets that have been
 	// sent to and acknowledged by clients. An offset is inserted into this map when
@@ -63,6 +121,29 @@ type claim struct {
 	tracking            map[int64]bool
 	outstandingMessages int
 
+	// deliveries holds the delivery state for each outstanding offset. Entries are added
+	// when a message is first queued and removed on commit.
+	deliveries map[int64]*delivery
+
+	// commitsSinceFlush counts commits since our offset was last recorded, for
+	// FlushEveryNMessages.
+	commitsSinceFlush int
+
+	// pendingCommits are waiting for an offset past theirs to be recorded in both the
+	// Marshal topic and Kafka.
+	pendingCommits []*CommitFuture
+
+	// throttledAt is the last time the messagePump had to wait for a rate limit.
+	throttledAt time.Time
+
+	// health is the outcome of the last health check.
+	health ClaimStatus
+
+	// stuckOffset is the lowest uncommitted offset as of the last heartbeat and stuckBeats
+	// is how many heartbeats in a row it has been so.
+	stuckOffset int64
+	stuckBeats  int
+
 	// Number of heartbeat cycles this claim has been lagging, i.e., consumption is going
 	// too slowly (defined as being behind by more than 2 heartbeat cycles)
 	cyclesBehind int
@@ -82,50 +163,86 @@ func newClaim(topic string, partID int, marshal *Marshaler, consumer *Consumer,
 	// Get all available offset information
 	offsets, err := marshal.GetPartitionOffsets(topic, partID)
 	if err != nil {
-		log.Errorf("[%s:%d] failed to get offsets: %s", topic, partID, err)
+		log.Error("failed to get offsets", partitionFields(marshal, topic, partID, "err", err)...)
 		return nil
 	}
-	log.Debugf("[%s:%d] consumer offsets: early = %d, cur/comm = %d/%d, late = %d",
-		topic, partID, offsets.Earliest, offsets.Current, offsets.Committed, offsets.Latest)
+	log.Debug("consumer offsets", partitionFields(marshal, topic, partID,
+		"earliest", offsets.Earliest, "current", offsets.Current,
+		"committed", offsets.Committed, "latest", offsets.Latest)...)
+
+	// If the consumer keeps its own offsets, those win: they're written transactionally
+	// with the consumer's output so they're the most accurate record we can get.
+	stored := false
+	if options.OffsetStore != nil {
+		var offset int64
+		offset, stored, err = options.OffsetStore.Load(marshal.GroupID(), topic, partID)
+		if err != nil {
+			log.Error("failed to load offset from store",
+				partitionFields(marshal, topic, partID, "err", err)...)
+			return nil
+		}
+		if stored {
+			log.Info("using offset from offset store",
+				partitionFields(marshal, topic, partID, "offset", offset)...)
+			offsets.Current = offset
+		}
+	}
 
 	// For offsets, we strictly prefer the contents of the MarshalTopic and will use that
 	// if present. If we don't have that data, then we'll fall back to the Kafka committed
-	// offsets. Failing that we'll start at the beginning of the partition.
-	if offsets.Current > 0 {
+	// offsets. Failing that we'll start wherever the InitialOffset option says.
+	offsetSource := "marshal"
+	if stored {
+		offsetSource = "offset store"
+	} else if offsets.Current > 0 {
 		// Ideal case, we just use the Marshal offset that is already set
 	} else if offsets.Committed > 0 {
-		log.Infof("[%s:%d] no Marshal offset found, using committed offset %d",
-			topic, partID, offsets.Committed)
+		log.Info("no Marshal offset found, using committed offset",
+			partitionFields(marshal, topic, partID, "offset", offsets.Committed)...)
 		offsets.Current = offsets.Committed
+		offsetSource = "committed"
 	} else {
-		log.Infof("[%s:%d] no Marshal or committed offset found, using earliest offset %d",
-			topic, partID, offsets.Earliest)
-		offsets.Current = offsets.Earliest
+		offsets.Current = options.InitialOffset.offset(offsets, options.InitialOffsetCount)
+		offsetSource = "initial " + options.InitialOffset.String()
+		log.Info("no Marshal or committed offset found, using initial offset",
+			partitionFields(marshal, topic, partID,
+				"initial", options.InitialOffset, "offset", offsets.Current)...)
 	}
 
 	// Construct object and set it up
 	obj := &claim{
 		lock:            &sync.RWMutex{},
 		messagesLock:    &sync.Mutex{},
+		storeLock:       &sync.Mutex{},
 		stopChan:        make(chan struct{}),
 		doneChan:        make(chan struct{}),
+		seekChan:        make(chan seekRequest),
 		marshal:         marshal,
 		consumer:        consumer,
 		topic:           topic,
 		partID:          partID,
+		id:              newClaimID(marshal),
 		terminated:      new(int32),
+		paused:          new(int32),
 		offsets:         offsets,
+		offsetSource:    offsetSource,
 		messages:        messages,
 		options:         options,
 		tracking:        make(map[int64]bool),
+		deliveries:      make(map[int64]*delivery),
 		rand:            rand.New(rand.NewSource(time.Now().UnixNano())),
 		lastMessageTime: time.Now(),
+		limiter:         newRateLimiter(options.PartitionRateLimit),
+	}
+	if consumer != nil {
+		obj.queueSlots = consumer.queueSlots
+		obj.queueBytes = consumer.queueBytes
 	}
 
 	// Now try to actually claim it, this can block a while
-	log.Infof("[%s:%d] consumer attempting to claim", topic, partID)
+	log.Info("consumer attempting to claim", partitionFields(marshal, topic, partID)...)
 	if !marshal.ClaimPartition(topic, partID) {
-		log.Infof("[%s:%d] consumer failed to claim", topic, partID)
+		log.Info("consumer failed to claim", partitionFields(marshal, topic, partID)...)
 		return nil
 	}
 
@@ -134,6 +251,11 @@ func newClaim(topic string, partID int, marshal *Marshaler, consumer *Consumer,
 	return obj
 }
 
+// newClaimID returns an ID for a new claim, see claim.id.
+func newClaimID(marshal *Marshaler) string {
+	return fmt.Sprintf("%s-%d", marshal.instanceID, atomic.AddInt64(&claimSequence, 1))
+}
+
 // setup is the initial worker that initializes the claim structure. Until this is done,
 // our internal state is inconsistent.
 func (c *claim) setup() {
@@ -143,32 +265,24 @@ func (c *claim) setup() {
 	// Of course, if the current offset is greater than the earliest, we must reset
 	// to the earliest known
 	if c.offsets.Current < c.offsets.Earliest {
-		log.Warningf("[%s:%d] consumer fast-forwarding from %d to %d",
-			c.topic, c.partID, c.offsets.Current, c.offsets.Earliest)
+		log.Warn("consumer fast-forwarding", c.logFields(
+			"from", c.offsets.Current, "to", c.offsets.Earliest)...)
 		c.offsets.Current = c.offsets.Earliest
 	}
 
 	// Since it's claimed, we now want to heartbeat with the last seen offset
 	err := c.marshal.Heartbeat(c.topic, c.partID, c.offsets.Current)
 	if err != nil {
-		log.Errorf("[%s:%d] consumer failed to heartbeat: %s", c.topic, c.partID, err)
+		log.Error("consumer failed to heartbeat", c.logFields("err", err)...)
 		go c.Release()
 		return
 	}
 	c.lastHeartbeat = time.Now().Unix()
 
 	// Set up Kafka consumer
-	consumerConf := kafka.NewConsumerConf(c.topic, int32(c.partID))
-	consumerConf.StartOffset = c.offsets.Current
-	consumerConf.MaxFetchSize = c.marshal.cluster.options.MaxMessageSize
-	consumerConf.RequestTimeout = c.marshal.cluster.options.ConsumeRequestTimeout
-	// Do not retry. If we get back no data, we'll do our own retries.
-	consumerConf.RetryLimit = 0
-
-	kafkaConsumer, err := c.marshal.cluster.broker.Consumer(consumerConf)
+	kafkaConsumer, err := c.newKafkaConsumer(c.offsets.Current)
 	if err != nil {
-		log.Errorf("[%s:%d] consumer failed to create Kafka Consumer: %s",
-			c.topic, c.partID, err)
+		log.Error("consumer failed to create Kafka Consumer", c.logFields("err", err)...)
 		go c.Release()
 		return
 	}
@@ -176,16 +290,63 @@ func (c *claim) setup() {
 
 	// Start our maintenance goroutines that keep this system healthy
 	go c.messagePump()
+	if c.options.VisibilityTimeout > 0 {
+		go c.visibilityLoop()
+	}
 
 	// Totally done, let the world know and move on
-	log.Infof("[%s:%d] consumer %s claimed at offset %d (is %d behind)",
-		c.topic, c.partID, c.marshal.clientID, c.offsets.Current, c.offsets.Latest-c.offsets.Current)
+	log.Info("consumer claimed partition", c.logFields("source", c.offsetSource,
+		"offset", c.offsets.Current, "behind", c.offsets.Latest-c.offsets.Current)...)
+}
+
+// newKafkaConsumer creates a Kafka consumer for our partition starting at the given offset.
+func (c *claim) newKafkaConsumer(offset int64) (kafka.Consumer, error) {
+	consumerConf := kafka.NewConsumerConf(c.topic, int32(c.partID))
+	consumerConf.StartOffset = offset
+	consumerConf.MaxFetchSize = c.marshal.cluster.options.MaxMessageSize
+	consumerConf.RequestTimeout = c.marshal.cluster.options.ConsumeRequestTimeout
+	// Do not retry. If we get back no data, we'll do our own retries.
+	consumerConf.RetryLimit = 0
+
+	return c.marshal.cluster.broker.Consumer(consumerConf)
 }
 
 // Commit is called by a Consumer class when the client has indicated that it has finished
 // processing a message. This updates our tracking structure so the heartbeat knows how
 // far ahead it can move our offset.
 func (c *claim) Commit(offset int64) error {
+	return c.commit(offset, anyEpoch)
+}
+
+// commitMessage is like Commit, but fails if the message wasn't read by this claim, or
+// was read before the claim was last moved to a new offset.
+func (c *claim) commitMessage(msg *Message) error {
+	if err := c.checkClaimID(msg.Offset, msg.claimID); err != nil {
+		return err
+	}
+	return c.commit(msg.Offset, msg.epoch)
+}
+
+// commitToken is like commitMessage, but for a CommitToken.
+func (c *claim) commitToken(token CommitToken) error {
+	if err := c.checkClaimID(token.offset, token.claimID); err != nil {
+		return err
+	}
+	return c.commit(token.offset, token.epoch)
+}
+
+// checkClaimID returns an error if an offset was read by another claim of this partition,
+// or isn't from a claim at all.
+func (c *claim) checkClaimID(offset int64, claimID string) error {
+	if claimID != c.id {
+		return fmt.Errorf("[%s:%d] offset %d was not read by this claim",
+			c.topic, c.partID, offset)
+	}
+	return nil
+}
+
+// commit marks an offset committed if it was read in the given epoch.
+func (c *claim) commit(offset int64, epoch int) error {
 	if c.Terminated() {
 		return fmt.Errorf("[%s:%d] is no longer claimed; can't commit offset %d",
 			c.topic, c.partID, offset)
@@ -194,14 +355,457 @@ func (c *claim) Commit(offset int64) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	_, ok := c.tracking[offset]
+	if err := c.checkEpoch(offset, epoch); err != nil {
+		return err
+	}
+	committed, ok := c.tracking[offset]
 	if !ok {
 		// This is bogus; committing an offset we've never seen?
 		return fmt.Errorf("[%s:%d] committing offset %d but we've never seen it",
 			c.topic, c.partID, offset)
+	} else if committed {
+		// Already done, don't count it twice
+		return nil
 	}
 	c.tracking[offset] = true
 	c.outstandingMessages--
+	delete(c.deliveries, offset)
+
+	c.commitsSinceFlush++
+	if n := c.options.FlushEveryNMessages; n > 0 && c.commitsSinceFlush >= n &&
+		c.consumer != nil {
+		c.consumer.requestFlush()
+	}
+	return nil
+}
+
+// commitAsync is like commitMessage, but returns a CommitFuture that resolves once the
+// offset has been durably recorded.
+func (c *claim) commitAsync(msg *Message) *CommitFuture {
+	future := newCommitFuture(c.topic, c.partID, msg.Offset)
+	if err := c.commitMessage(msg); err != nil {
+		future.resolve(err)
+		return future
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// We might have been torn down since the commit, in which case nothing else will
+	// ever resolve the future
+	if c.Terminated() {
+		future.resolve(fmt.Errorf("[%s:%d] is no longer claimed; offset %d may not be recorded",
+			c.topic, c.partID, msg.Offset))
+		return future
+	}
+	c.pendingCommits = append(c.pendingCommits, future)
+	return future
+}
+
+// resolveCommits is called when offset has been recorded in the Marshal topic and Kafka,
+// and resolves the pending commits that it covers. The caller must hold the lock.
+func (c *claim) resolveCommits(offset int64) {
+	remaining := c.pendingCommits[:0]
+	for _, future := range c.pendingCommits {
+		if future.offset < offset {
+			future.resolve(nil)
+		} else {
+			remaining = append(remaining, future)
+		}
+	}
+	c.pendingCommits = remaining
+}
+
+// failCommits resolves all pending commits with an error. The caller must hold the lock.
+func (c *claim) failCommits(err error) {
+	for _, future := range c.pendingCommits {
+		future.resolve(err)
+	}
+	c.pendingCommits = nil
+}
+
+// checkEpoch returns an error if a message from the given epoch is stale. The caller must
+// hold the lock.
+func (c *claim) checkEpoch(offset int64, epoch int) error {
+	if epoch != anyEpoch && epoch != c.epoch {
+		return fmt.Errorf("[%s:%d] offset %d was read before the claim was repositioned",
+			c.topic, c.partID, offset)
+	}
+	return nil
+}
+
+// CommitTx commits a message, first calling the hook with the offset that is safe to
+// record for this partition once that commit has happened. If the hook fails, the message
+// is left uncommitted. Like commitMessage, this fails if the message wasn't read by this
+// claim, or was read before the claim was last moved to a new offset.
+func (c *claim) CommitTx(msg *Message, hook func(int64) error) error {
+	offset := msg.Offset
+	if c.Terminated() {
+		return fmt.Errorf("[%s:%d] is no longer claimed; can't commit offset %d",
+			c.topic, c.partID, offset)
+	}
+	if err := c.checkClaimID(offset, msg.claimID); err != nil {
+		return err
+	}
+
+	// Held across the hook so that recorded offsets are written in the order they
+	// are computed
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+
+	safeOffset, err := func() (int64, error) {
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+
+		if err := c.checkEpoch(offset, msg.epoch); err != nil {
+			return 0, err
+		}
+		committed, ok := c.tracking[offset]
+		if !ok {
+			return 0, fmt.Errorf("[%s:%d] committing offset %d but we've never seen it",
+				c.topic, c.partID, offset)
+		} else if committed {
+			return 0, fmt.Errorf("[%s:%d] committing offset %d but it is already committed",
+				c.topic, c.partID, offset)
+		}
+
+		// The safe offset is the oldest message that won't be committed after this one is,
+		// or just past the newest one we've seen if everything will be committed.
+		lowest, found := int64(0), false
+		highest := c.offsets.Current - 1
+		for tracked, committed := range c.tracking {
+			if tracked > highest {
+				highest = tracked
+			}
+			if !committed && tracked != offset && (!found || tracked < lowest) {
+				lowest, found = tracked, true
+			}
+		}
+		if found {
+			return lowest, nil
+		}
+		return highest + 1, nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	if err := hook(safeOffset); err != nil {
+		return fmt.Errorf("[%s:%d] commit hook failed for offset %d: %s",
+			c.topic, c.partID, offset, err)
+	}
+	return c.commit(offset, msg.epoch)
+}
+
+// Nack is called by a Consumer class when the client has failed to process a message. The
+// message is scheduled for redelivery, or, if it has been delivered too many times already,
+// dead-lettered and committed.
+func (c *claim) Nack(msg *Message, delay time.Duration) error {
+	if c.Terminated() {
+		return fmt.Errorf("[%s:%d] is no longer claimed; can't nack offset %d",
+			c.topic, c.partID, msg.Offset)
+	}
+	if err := c.checkClaimID(msg.Offset, msg.claimID); err != nil {
+		return err
+	}
+
+	attempts, err := func() (int, error) {
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+
+		if err := c.checkEpoch(msg.Offset, msg.epoch); err != nil {
+			return 0, err
+		}
+		committed, ok := c.tracking[msg.Offset]
+		if !ok {
+			return 0, fmt.Errorf("[%s:%d] nacking offset %d but we've never seen it",
+				c.topic, c.partID, msg.Offset)
+		} else if committed {
+			return 0, fmt.Errorf("[%s:%d] nacking offset %d but it is already committed",
+				c.topic, c.partID, msg.Offset)
+		}
+		if dl, ok := c.deliveries[msg.Offset]; ok {
+			return dl.attempts, nil
+		}
+		return 0, nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	if delay <= 0 {
+		delay = c.nackBackoff(attempts)
+	}
+	log.Debug("offset nacked, redelivering", c.logFields(
+		"offset", msg.Offset, "attempts", attempts, "delay", delay)...)
+	return c.retry(msg, attempts, delay)
+}
+
+// retry schedules an outstanding message for redelivery after delay. If the message has
+// used up its delivery attempts it is dead-lettered and committed instead. If the
+// dead-letter produce fails we leave the offset outstanding so the caller can try again.
+func (c *claim) retry(msg *Message, attempts int, delay time.Duration) error {
+	// Mark the offset as waiting so nothing else retries it before it's redelivered. The
+	// visibility timeout also leaves it alone while deliveredAt is zero.
+	c.lock.Lock()
+	if err := c.checkEpoch(msg.Offset, msg.epoch); err != nil {
+		c.lock.Unlock()
+		return err
+	}
+	dl, ok := c.deliveries[msg.Offset]
+	if ok && dl.retrying {
+		c.lock.Unlock()
+		return fmt.Errorf("[%s:%d] offset %d is already waiting to be redelivered",
+			c.topic, c.partID, msg.Offset)
+	}
+	if ok {
+		dl.retrying = true
+		dl.deliveredAt = time.Time{}
+	}
+	c.lock.Unlock()
+
+	if c.options.MaxDeliveryAttempts > 0 && attempts >= c.options.MaxDeliveryAttempts {
+		if err := c.deadLetter(msg, attempts); err != nil {
+			// Leave it outstanding so the caller can try again
+			c.lock.Lock()
+			if ok {
+				dl.retrying = false
+			}
+			c.lock.Unlock()
+			return err
+		}
+		// Refuse to commit if the claim moved while we were producing, as then the offset
+		// belongs to a message that hasn't been processed
+		return c.commit(msg.Offset, msg.epoch)
+	}
+
+	time.AfterFunc(delay, func() { c.redeliver(msg) })
+	return nil
+}
+
+// nackBackoff returns how long to wait before redelivering a message that has been
+// delivered the given number of times. A NackBackoffMax of 0 means no cap.
+func (c *claim) nackBackoff(attempts int) time.Duration {
+	max := c.options.NackBackoffMax
+	delay := c.options.NackBackoffMin
+	for i := 1; i < attempts && (max <= 0 || delay < max); i++ {
+		if delay > math.MaxInt64/2 {
+			return time.Duration(math.MaxInt64)
+		}
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// redeliver puts an outstanding message back on the messages channel. This follows the
+// same rules as the messagePump: the write is serialized with teardown via messagesLock.
+func (c *claim) redeliver(msg *Message) {
+	c.messagesLock.Lock()
+	defer c.messagesLock.Unlock()
+
+	if c.Terminated() {
+		return
+	}
+
+	// The client may still be holding on to the old message, so hand out a copy
+	c.lock.Lock()
+	dl, ok := c.deliveries[msg.Offset]
+	if !ok || c.tracking[msg.Offset] || msg.epoch != c.epoch {
+		// Committed or repositioned while we were waiting, nothing to redeliver
+		c.lock.Unlock()
+		return
+	}
+	dl.attempts++
+	dl.retrying = false
+	tmp := *msg
+	tmp.DeliveryAttempt = dl.attempts
+	c.lock.Unlock()
+
+	if ok, _ := c.reserve(&tmp, nil); !ok {
+		return
+	}
+	select {
+	case c.messages <- &tmp:
+		c.queued(&tmp)
+	case <-c.stopChan:
+		// Claim is terminated, the message will go nowhere
+		c.unreserve(&tmp)
+	}
+}
+
+// reserve waits for room in the consumer's queue budget, both a message slot and the bytes
+// for msg, so we can buffer it. It gives up if the claim is stopped or a seek request
+// arrives on seekChan, which is returned so the caller can handle it.
+func (c *claim) reserve(msg *Message, seekChan chan seekRequest) (bool, *seekRequest) {
+	if c.queueSlots == nil {
+		return true, nil
+	}
+	select {
+	case c.queueSlots <- struct{}{}:
+	case req := <-seekChan:
+		return false, &req
+	case <-c.stopChan:
+		return false, nil
+	}
+
+	size := messageSize(msg)
+	for {
+		ok, freed := c.queueBytes.tryAcquire(size)
+		if ok {
+			return true, nil
+		}
+		select {
+		case <-freed:
+		case req := <-seekChan:
+			<-c.queueSlots
+			return false, &req
+		case <-c.stopChan:
+			<-c.queueSlots
+			return false, nil
+		}
+	}
+}
+
+// unreserve gives back what reserve took for msg, once it has left our buffer.
+func (c *claim) unreserve(msg *Message) {
+	if c.queueSlots != nil {
+		c.queueBytes.release(messageSize(msg))
+		<-c.queueSlots
+	}
+}
+
+// queued is called when a message has been put in our buffer. Without a consumer the buffer
+// is read directly, so that counts as delivered; otherwise the consumer marks the message
+// delivered when it hands it out.
+func (c *claim) queued(msg *Message) {
+	if c.consumer == nil {
+		c.markDelivered(msg)
+		return
+	}
+	c.consumer.notifyQueued()
+}
+
+// dropQueued discards the messages in our buffer that haven't been handed out yet and
+// returns how many there were. Without a consumer the buffer isn't ours to drain.
+func (c *claim) dropQueued() int {
+	if c.consumer == nil {
+		return 0
+	}
+	for dropped := 0; ; dropped++ {
+		select {
+		case msg := <-c.messages:
+			c.unreserve(msg)
+		default:
+			return dropped
+		}
+	}
+}
+
+// markDelivered records that a message has just been put on the messages channel, which
+// starts its visibility timeout.
+func (c *claim) markDelivered(msg *Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	dl, ok := c.deliveries[msg.Offset]
+	if !ok {
+		return
+	}
+	dl.deliveredAt = time.Now()
+	if c.options.VisibilityTimeout > 0 {
+		dl.msg = msg
+	}
+}
+
+// expiredDeliveries returns the outstanding messages whose visibility timeout has passed
+// without them being committed, along with their delivery attempts.
+func (c *claim) expiredDeliveries() ([]*Message, []int) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var msgs []*Message
+	var attempts []int
+	deadline := time.Now().Add(-c.options.VisibilityTimeout)
+	for offset, dl := range c.deliveries {
+		if dl.msg == nil || dl.deliveredAt.IsZero() || dl.retrying || c.tracking[offset] {
+			continue
+		}
+		if dl.deliveredAt.Before(deadline) {
+			msgs = append(msgs, dl.msg)
+			attempts = append(attempts, dl.attempts)
+		}
+	}
+	return msgs, attempts
+}
+
+// visibilityLoop periodically redelivers messages that have been outstanding for longer
+// than the VisibilityTimeout. Exits when this claim has been terminated.
+func (c *claim) visibilityLoop() {
+	interval := c.options.VisibilityTimeout / 2
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		case <-ticker.C:
+		}
+
+		msgs, attempts := c.expiredDeliveries()
+		for i, msg := range msgs {
+			log.Warn("offset not committed within visibility timeout, redelivering",
+				c.logFields("offset", msg.Offset, "timeout", c.options.VisibilityTimeout,
+					"attempt", attempts[i])...)
+			c.report(&VisibilityTimeoutError{Topic: c.topic, Partition: c.partID,
+				Offset: msg.Offset, Attempt: attempts[i], Timeout: c.options.VisibilityTimeout})
+			if err := c.retry(msg, attempts[i], 0); err != nil {
+				log.Error("failed to redeliver offset",
+					c.logFields("offset", msg.Offset, "err", err)...)
+			}
+		}
+	}
+}
+
+// deadLetter produces a message that has run out of delivery attempts to the configured
+// dead-letter topic. If there is no such topic the message is simply dropped. Where the
+// message came from is put in front of its key, see DeadLetter.
+func (c *claim) deadLetter(msg *Message, attempts int) error {
+	topic := c.options.DeadLetterTopic
+	if topic == "" {
+		log.Warn("discarding offset after too many delivery attempts",
+			c.logFields("offset", msg.Offset, "attempts", attempts)...)
+		return nil
+	}
+
+	partitions := c.marshal.Partitions(topic)
+	if partitions <= 0 {
+		return fmt.Errorf("[%s:%d] dead-letter topic %s not found", c.topic, c.partID, topic)
+	}
+
+	key := DeadLetter{
+		Topic:     c.topic,
+		Partition: int32(c.partID),
+		Offset:    msg.Offset,
+		Attempts:  attempts,
+		Key:       msg.Key,
+	}.encodeKey()
+
+	// Keep messages from the same partition together in the dead-letter topic
+	_, err := c.marshal.cluster.producer.Produce(topic, msg.Partition%int32(partitions),
+		&proto.Message{Key: key, Value: msg.Value})
+	if err != nil {
+		return fmt.Errorf("[%s:%d] failed to produce offset %d to dead-letter topic %s: %s",
+			c.topic, c.partID, msg.Offset, topic, err)
+	}
+	log.Warn("offset sent to dead-letter topic after too many delivery attempts",
+		c.logFields("offset", msg.Offset, "dead_letter_topic", topic, "attempts", attempts)...)
 	return nil
 }
 
@@ -211,6 +815,41 @@ func (c *claim) Terminated() bool {
 	return atomic.LoadInt32(c.terminated) == 1
 }
 
+// Pause stops the claim from fetching messages from Kafka. The claim is kept: we continue
+// to heartbeat and the velocity health checks are suspended until Resume is called.
+func (c *claim) Pause() {
+	if atomic.CompareAndSwapInt32(c.paused, 0, 1) {
+		log.Info("pausing consumption", c.logFields()...)
+	}
+}
+
+// Resume undoes Pause.
+func (c *claim) Resume() {
+	if atomic.CompareAndSwapInt32(c.paused, 1, 0) {
+		log.Info("resuming consumption", c.logFields()...)
+		c.resetHealth()
+	}
+}
+
+// Paused returns whether this claim is paused, either by itself or because the whole
+// consumer has been paused.
+func (c *claim) Paused() bool {
+	return atomic.LoadInt32(c.paused) == 1 || (c.consumer != nil && c.consumer.Paused())
+}
+
+// resetHealth forgets our velocity history so that time spent paused doesn't count
+// against us when we start consuming again.
+func (c *claim) resetHealth() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lastMessageTime = time.Now()
+	c.offsetCurrentHistory = [10]int64{}
+	c.offsetLatestHistory = [10]int64{}
+	c.beatCounter = 0
+	c.cyclesBehind = 0
+}
+
 // GetCurrentLag returns this partition's cursor lag.
 func (c *claim) GetCurrentLag() int64 {
 	c.lock.RLock()
@@ -222,6 +861,31 @@ func (c *claim) GetCurrentLag() int64 {
 	return 0
 }
 
+// timeLag returns estimates of how far behind this partition is in time.
+func (c *claim) timeLag() PartitionTimeLag {
+	// The velocities take the lock, so get them first
+	consumerVelocity := c.ConsumerVelocity()
+	partitionVelocity := c.PartitionVelocity()
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return newPartitionTimeLag(c.healthInputs(consumerVelocity, partitionVelocity))
+}
+
+// newPartitionTimeLag returns the time lag estimates for a claim's health inputs.
+func newPartitionTimeLag(h ClaimHealth) PartitionTimeLag {
+	catchUp, catchingUp := h.CatchUpTime()
+	return PartitionTimeLag{
+		Topic:      h.Topic,
+		PartID:     h.Partition,
+		Lag:        h.Lag(),
+		Behind:     h.TimeLag(),
+		CatchUp:    catchUp,
+		CatchingUp: catchingUp,
+	}
+}
+
 // Flush will write updated offsets to Kafka immediately if we have any outstanding offset
 // updates to write. If not, this is a relatively quick no-op.
 func (c *claim) Flush() error {
@@ -240,13 +904,52 @@ func (c *claim) Flush() error {
 	}
 
 	// Now heartbeat this value and update our heartbeat time
-	if err := c.marshal.Heartbeat(c.topic, c.partID, currentOffset); err != nil {
+	committed, err := c.marshal.heartbeat(c.topic, c.partID, currentOffset)
+	return c.flushed(currentOffset, heartbeatResult{committed, err})
+}
+
+// flushed is called with the result of heartbeating offset outside of the health check
+// loop. On failure we release the claim, as we do for any failed heartbeat.
+func (c *claim) flushed(offset int64, result heartbeatResult) error {
+	if result.err != nil {
+		c.lost(result.err)
 		go c.Release()
-		return fmt.Errorf("[%s:%d] failed to flush, releasing: %s", c.topic, c.partID, err)
+		return fmt.Errorf("[%s:%d] failed to flush, releasing: %s",
+			c.topic, c.partID, result.err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lastHeartbeat = time.Now().Unix()
+	c.commitsSinceFlush = 0
+	if result.committed {
+		c.resolveCommits(offset)
 	}
 	return nil
 }
 
+// logFields returns the fields identifying this claim in log messages, followed by keyvals.
+func (c *claim) logFields(keyvals ...interface{}) []interface{} {
+	return partitionFields(c.marshal, c.topic, c.partID, keyvals...)
+}
+
+// lost tells the consumer that we're giving up the claim because of err, as opposed to
+// releasing it in the normal course of balancing.
+func (c *claim) lost(err error) {
+	if _, ok := err.(*FencedError); !ok {
+		err = &ClaimLostError{Topic: c.topic, Partition: c.partID, Err: err}
+	}
+	c.report(err)
+}
+
+// report sends an error to our consumer's Errors channel, if we have a consumer.
+func (c *claim) report(err error) {
+	if c.consumer != nil {
+		c.consumer.reportError(err)
+	}
+}
+
 // Release will invoke commit offsets and release the Kafka partition. After calling Release,
 // consumer cannot consume messages anymore.
 // Does not return until the message pump has exited and the release has finished.
@@ -284,21 +987,32 @@ func (c *claim) teardown(releasePartition bool) bool {
 		go c.consumer.claimTerminated(c, releasePartition)
 	}
 
+	var committed bool
 	var err error
 	if releasePartition {
-		log.Infof("[%s:%d] releasing partition claim", c.topic, c.partID)
-		err = c.marshal.ReleasePartition(c.topic, c.partID, currentOffset)
+		log.Info("releasing partition claim", c.logFields()...)
+		committed, err = c.marshal.releasePartition(c.topic, c.partID, currentOffset)
 	} else {
 		// We're not releasing but we do want to update our offsets to the latest value
 		// we know about, so issue a gratuitous heartbeat
-		err = c.marshal.Heartbeat(c.topic, c.partID, currentOffset)
+		committed, err = c.marshal.heartbeat(c.topic, c.partID, currentOffset)
 	}
 
-	// Wait for messagePump to exit
+	// This is our last chance to record offsets, so anything still pending has failed
+	c.lock.Lock()
+	if err == nil && committed {
+		c.resolveCommits(currentOffset)
+	}
+	c.failCommits(fmt.Errorf("[%s:%d] claim ended before offset was recorded",
+		c.topic, c.partID))
+	c.lock.Unlock()
+
+	// Wait for messagePump to exit, after which nothing else can be queued
 	<-c.doneChan
+	c.dropQueued()
 
 	if err != nil {
-		log.Errorf("[%s:%d] failed to release: %s", c.topic, c.partID, err)
+		log.Error("failed to release", c.logFields("err", err)...)
 		return false
 	}
 	return true
@@ -311,26 +1025,51 @@ func (c *claim) messagePump() {
 	// possible for the pump to be running
 	defer close(c.doneChan)
 
-	// This method MUST NOT make changes to the claim structure. Since we might
-	// be running while someone else has the lock, and we can't get it ourselves, we are
-	// forbidden to touch anything other than the consumer and the message channel.
+	// The pump owns the Kafka consumer; nothing else may touch it. The pump may change the
+	// claim structure only by taking the lock briefly, as resetPosition does when it moves
+	// us (from recoverOutOfRange or handleSeek). It must never hold the lock while waiting
+	// on Kafka or on the message channel, since teardown and others may be holding it while
+	// they wait for us.
 	retry := &backoff.Backoff{Min: 10 * time.Millisecond, Max: 1 * time.Second, Jitter: true}
+	c.lock.RLock()
+	nextOffset := c.offsets.Current
+	c.lock.RUnlock()
 	for !c.Terminated() {
+		select {
+		case req := <-c.seekChan:
+			nextOffset = c.handleSeek(req, nextOffset)
+			continue
+		default:
+		}
+
+		// While paused we don't fetch anything, but we can still seek
+		if c.Paused() {
+			select {
+			case req := <-c.seekChan:
+				nextOffset = c.handleSeek(req, nextOffset)
+			case <-c.stopChan:
+			case <-time.After(pausePollInterval):
+			}
+			continue
+		}
+
 		msg, err := c.kafkaConsumer.Consume()
 		if err == proto.ErrOffsetOutOfRange {
-			// Fell out of range, presumably because we're handling this too slow, so
-			// let's abandon this claim
-			log.Warningf("[%s:%d] error consuming: out of range, abandoning partition",
-				c.topic, c.partID)
-			go c.Release()
-			return
+			// Fell out of range, presumably because we're handling this too slow. What
+			// we do about that is up to the OffsetOutOfRangePolicy.
+			newOffset, ok := c.recoverOutOfRange(nextOffset)
+			if !ok {
+				return
+			}
+			nextOffset = newOffset
+			continue
 		} else if err == kafka.ErrNoData {
 			// No data, just loop; if we're stuck receiving no data for too long the healthcheck
 			// will start failing
 			time.Sleep(retry.Duration())
 			continue
 		} else if err != nil {
-			log.Errorf("[%s:%d] error consuming: %s", c.topic, c.partID, err)
+			log.Error("error consuming", c.logFields("err", err)...)
 
 			// Often a consumption error is caused by data going away, such as if we're consuming
 			// from the head and Kafka has deleted the data. In that case we need to wait for
@@ -339,13 +1078,22 @@ func (c *claim) messagePump() {
 			continue
 		}
 		retry.Reset()
+		nextOffset = msg.Offset + 1
+
+		// Hold the message back if we're over a rate limit
+		if seek := c.throttle(msg); seek != nil {
+			nextOffset = c.handleSeek(*seek, nextOffset)
+			continue
+		}
 
 		// Briefly get the lock to update our tracking map... I wish there were
 		// goroutine safe maps in Go.
 		c.lock.Lock()
 		c.lastMessageTime = time.Now()
 		c.tracking[msg.Offset] = false
+		c.deliveries[msg.Offset] = &delivery{attempts: 1, queuedAt: c.lastMessageTime}
 		c.outstandingMessages++
+		epoch := c.epoch
 		c.lock.Unlock()
 
 		// Push the message down to the client (this bypasses the Consumer)
@@ -357,22 +1105,216 @@ func (c *claim) messagePump() {
 		//
 		// This must not block -- if we hold the messagesLock for too long we will cause
 		// possible deadlocks.
+		var seek *seekRequest
 		c.messagesLock.Lock()
 		if !c.Terminated() {
 			// This allocates a new Message to put the proto.Message in.
 			// TODO: This is really annoying and probably stupidly inefficient, is there any
 			// way to do this better?
-			tmp := Message(*msg)
-			select {
-			case c.messages <- &tmp:
-				// Message successfully delivered to queue
-			case <-c.stopChan:
-				// Claim is terminated, the message will go nowhere
+			tmp := &Message{Message: *msg, DeliveryAttempt: 1, claimID: c.id, epoch: epoch}
+
+			// Wait for room in the consumer's queue. If we're seeking instead then this
+			// message is no longer wanted.
+			var ok bool
+			if ok, seek = c.reserve(tmp, c.seekChan); ok {
+				select {
+				case c.messages <- tmp:
+					c.queued(tmp)
+				case req := <-c.seekChan:
+					c.unreserve(tmp)
+					seek = &req
+				case <-c.stopChan:
+					// Claim is terminated, the message will go nowhere
+					c.unreserve(tmp)
+				}
 			}
 		}
 		c.messagesLock.Unlock()
+
+		// Seek outside of the messagesLock since it talks to Kafka
+		if seek != nil {
+			nextOffset = c.handleSeek(*seek, nextOffset)
+		}
+	}
+	log.Debug("no longer claimed, pump exiting", c.logFields()...)
+}
+
+// throttle waits as long as the consumer and partition rate limits require before msg can
+// be handed out. If a seek request arrives meanwhile it is returned, and msg should be
+// dropped.
+func (c *claim) throttle(msg *proto.Message) *seekRequest {
+	size := int64(len(msg.Key) + len(msg.Value))
+	wait := c.limiter.take(size)
+	if c.consumer != nil {
+		if consumerWait := c.consumer.limiter.take(size); consumerWait > wait {
+			wait = consumerWait
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+
+	c.lock.Lock()
+	c.throttledAt = time.Now()
+	c.lock.Unlock()
+
+	select {
+	case <-time.After(wait):
+	case req := <-c.seekChan:
+		return &req
+	case <-c.stopChan:
+	}
+	return nil
+}
+
+// recoverOutOfRange is called by the messagePump when Kafka no longer has the offset we're
+// trying to consume. Depending on the OffsetOutOfRangePolicy we either move the claim to a
+// new offset and return it, or start releasing the claim and return false.
+func (c *claim) recoverOutOfRange(offset int64) (int64, bool) {
+	offsets, err := c.marshal.GetPartitionOffsets(c.topic, c.partID)
+	if err != nil {
+		log.Error("offset out of range and failed to get offsets, abandoning partition",
+			c.logFields("offset", offset, "err", err)...)
+		c.lost(err)
+		go c.Release()
+		return 0, false
 	}
-	log.Debugf("[%s:%d] no longer claimed, pump exiting", c.topic, c.partID)
+
+	policy := c.options.OffsetOutOfRangePolicy
+	if policy == OffsetOutOfRangeCallback {
+		policy = OffsetOutOfRangeRelease
+		if c.options.OffsetOutOfRangeHandler != nil {
+			policy = c.options.OffsetOutOfRangeHandler(c.topic, c.partID, offset, offsets)
+		}
+	}
+
+	var newOffset int64
+	switch policy {
+	case OffsetOutOfRangeResetEarliest:
+		newOffset = offsets.Earliest
+	case OffsetOutOfRangeResetLatest:
+		newOffset = offsets.Latest
+	default:
+		log.Warn("offset out of range, abandoning partition", c.logFields("offset", offset)...)
+		c.lost(fmt.Errorf("offset %d out of range", offset))
+		go c.Release()
+		return 0, false
+	}
+
+	log.Warn("offset out of range, resetting", c.logFields("offset", offset,
+		"earliest", offsets.Earliest, "latest", offsets.Latest, "new_offset", newOffset)...)
+	if err := c.resetPosition(newOffset); err != nil {
+		log.Error("failed to reset offset, releasing",
+			c.logFields("offset", newOffset, "err", err)...)
+		c.lost(err)
+		go c.Release()
+		return 0, false
+	}
+	if newOffset > offset {
+		log.Warn("skipped offsets that were never consumed", c.logFields(
+			"from", offset, "to", newOffset-1, "skipped", newOffset-offset)...)
+
+		// Record the range in the Marshal topic so it outlives us. If we can't, the range is
+		// only known to our consumer, so make sure the application hears about it.
+		if err := c.marshal.recordSkip(c.topic, c.partID, offset, newOffset); err != nil {
+			log.Error("failed to record skipped offsets",
+				c.logFields("from", offset, "to", newOffset-1, "err", err)...)
+			c.report(fmt.Errorf("[%s:%d] skipped offsets %d..%d and failed to record it: %s",
+				c.topic, c.partID, offset, newOffset-1, err))
+		}
+	}
+
+	// In a goroutine since the consumer might be holding its lock waiting for us to exit
+	if c.consumer != nil {
+		go c.consumer.recordOffsetReset(OffsetReset{
+			Topic:  c.topic,
+			PartID: c.partID,
+			From:   offset,
+			To:     newOffset,
+			Time:   time.Now(),
+		})
+	}
+	return newOffset, true
+}
+
+// SeekTo moves this claim to consume from the given offset. This is handed off to the
+// messagePump, which owns the Kafka consumer; we wait for it to finish.
+func (c *claim) SeekTo(offset int64) error {
+	if c.Terminated() {
+		return fmt.Errorf("[%s:%d] is no longer claimed; can't seek to offset %d",
+			c.topic, c.partID, offset)
+	}
+
+	req := seekRequest{offset: offset, done: make(chan error, 1)}
+	select {
+	case c.seekChan <- req:
+	case <-c.doneChan:
+		return fmt.Errorf("[%s:%d] is no longer claimed; can't seek to offset %d",
+			c.topic, c.partID, offset)
+	}
+	return <-req.done
+}
+
+// handleSeek is called by the messagePump to process a SeekTo request. Returns the offset
+// the pump is now consuming from.
+func (c *claim) handleSeek(req seekRequest, nextOffset int64) int64 {
+	offsets, err := c.marshal.GetPartitionOffsets(c.topic, c.partID)
+	if err != nil {
+		req.done <- fmt.Errorf("[%s:%d] failed to get offsets: %s", c.topic, c.partID, err)
+		return nextOffset
+	}
+	if req.offset < offsets.Earliest || req.offset > offsets.Latest {
+		req.done <- fmt.Errorf("[%s:%d] can't seek to offset %d, partition has %d..%d",
+			c.topic, c.partID, req.offset, offsets.Earliest, offsets.Latest)
+		return nextOffset
+	}
+
+	if err := c.resetPosition(req.offset); err != nil {
+		log.Error("failed to seek, releasing", c.logFields("offset", req.offset, "err", err)...)
+		req.done <- err
+		c.lost(err)
+		go c.Release()
+		return nextOffset
+	}
+
+	log.Info("seeked", c.logFields("from", nextOffset, "to", req.offset)...)
+	req.done <- nil
+	return req.offset
+}
+
+// resetPosition moves this claim to consume from the given offset. We forget about any
+// messages we were tracking, heartbeat the new offset immediately so the move is recorded
+// in the Marshal topic, and start a new Kafka consumer. This must only be called from the
+// messagePump goroutine since it replaces the Kafka consumer.
+func (c *claim) resetPosition(offset int64) error {
+	c.lock.Lock()
+	c.epoch++
+	c.offsets.Current = offset
+	c.tracking = make(map[int64]bool)
+	c.deliveries = make(map[int64]*delivery)
+	c.outstandingMessages = 0
+	c.failCommits(fmt.Errorf("[%s:%d] claim moved to offset %d before commit was recorded",
+		c.topic, c.partID, offset))
+	c.lock.Unlock()
+
+	// Anything we've buffered but not handed out is from the old position
+	if dropped := c.dropQueued(); dropped > 0 {
+		log.Info("dropped queued messages", c.logFields("dropped", dropped)...)
+	}
+
+	if err := c.marshal.Heartbeat(c.topic, c.partID, offset); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.lastHeartbeat = time.Now().Unix()
+	c.lock.Unlock()
+
+	kafkaConsumer, err := c.newKafkaConsumer(offset)
+	if err != nil {
+		return err
+	}
+	c.kafkaConsumer = kafkaConsumer
+	return nil
 }
 
 // heartbeat is the internal "send a heartbeat" function. Calling this will immediately
@@ -389,16 +1331,19 @@ func (c *claim) heartbeat() bool {
 	defer c.lock.Unlock()
 
 	// Now heartbeat this value and update our heartbeat time
-	err := c.marshal.Heartbeat(c.topic, c.partID, c.offsets.Current)
+	committed, err := c.marshal.heartbeat(c.topic, c.partID, c.offsets.Current)
 	if err != nil {
-		log.Errorf("[%s:%d] failed to heartbeat, releasing: %s", c.topic, c.partID, err)
+		log.Error("failed to heartbeat, releasing", c.logFields("err", err)...)
+		c.lost(err)
 		go c.Release()
+	} else if committed {
+		c.resolveCommits(c.offsets.Current)
 	}
+	c.commitsSinceFlush = 0
 
-	log.Infof("[%s:%d] heartbeat: Current offset is %d, partition offset range is %d..%d.",
-		c.topic, c.partID, c.offsets.Current, c.offsets.Earliest, c.offsets.Latest)
-	log.Infof("[%s:%d] heartbeat: There are %d messages in queue and %d messages outstanding.",
-		c.topic, c.partID, len(c.messages), c.outstandingMessages)
+	log.Info("heartbeat", c.logFields("current", c.offsets.Current,
+		"earliest", c.offsets.Earliest, "latest", c.offsets.Latest,
+		"queued", len(c.messages), "outstanding", c.outstandingMessages)...)
 	c.lastHeartbeat = time.Now().Unix()
 	return true
 }
@@ -435,12 +1380,82 @@ func (c *claim) updateCurrentOffsets() (bool, int64) {
 	// probably broken in the implementation... since that will cause us to grow
 	// forever in memory, let's alert the user
 	if len(c.tracking) > c.marshal.cluster.options.MaxMessageQueue {
-		log.Errorf("[%s:%d] has %d uncommitted offsets. You must call Commit.",
-			c.topic, c.partID, len(c.tracking))
+		oo, _ := c.outstandingOffset()
+		log.Error("too many uncommitted offsets, you must call Commit", c.logFields(
+			"uncommitted", len(c.tracking), "oldest", oo.Offset, "blocked", oo.Blocked)...)
 	}
 	return didAdvance, c.offsets.Current
 }
 
+// outstandingOffset finds the lowest uncommitted offset we're tracking. Returns false if
+// there is none. The caller must hold the lock.
+func (c *claim) outstandingOffset() (OutstandingOffset, bool) {
+	lowest, found := int64(0), false
+	for offset, committed := range c.tracking {
+		if !committed && (!found || offset < lowest) {
+			lowest, found = offset, true
+		}
+	}
+	if !found {
+		return OutstandingOffset{}, false
+	}
+
+	oo := OutstandingOffset{
+		Topic:  c.topic,
+		PartID: c.partID,
+		Offset: lowest,
+	}
+	for offset, committed := range c.tracking {
+		if committed && offset > lowest {
+			oo.Blocked++
+		}
+	}
+	if dl, ok := c.deliveries[lowest]; ok && !dl.queuedAt.IsZero() {
+		oo.Age = time.Since(dl.queuedAt)
+	}
+	if c.stuckOffset == lowest {
+		oo.Heartbeats = c.stuckBeats
+	}
+	return oo, true
+}
+
+// OutstandingOffset returns information about the lowest uncommitted offset in this claim.
+// Returns false if every message we've delivered has been committed.
+func (c *claim) OutstandingOffset() (OutstandingOffset, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.outstandingOffset()
+}
+
+// updateStuckOffset is called once per heartbeat cycle to count how long the lowest
+// uncommitted offset has been holding us back, and to alert the user if it has been
+// doing so for too long.
+func (c *claim) updateStuckOffset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	oo, ok := c.outstandingOffset()
+	if !ok {
+		c.stuckOffset, c.stuckBeats = 0, 0
+		return
+	}
+	if oo.Offset != c.stuckOffset {
+		c.stuckOffset, c.stuckBeats = oo.Offset, 0
+	}
+	c.stuckBeats++
+	oo.Heartbeats = c.stuckBeats
+
+	if c.options.StuckOffsetHeartbeats <= 0 || c.stuckBeats != c.options.StuckOffsetHeartbeats {
+		return
+	}
+	log.Warn("offset stuck uncommitted", c.logFields("offset", oo.Offset,
+		"heartbeats", oo.Heartbeats, "age", oo.Age, "blocked", oo.Blocked)...)
+	if c.options.StuckOffsetHandler != nil {
+		go c.options.StuckOffsetHandler(oo)
+	}
+}
+
 // heartbeatExpired returns whether or not our last successful heartbeat is so
 // long ago that we know we're expired.
 func (c *claim) heartbeatExpired() bool {
@@ -467,89 +1482,168 @@ func (c *claim) healthCheck() bool {
 	// If our heartbeat is expired, we are definitely unhealthy... don't even bother
 	// with checking velocity
 	if c.heartbeatExpired() {
-		log.Warningf("[%s:%d] consumer unhealthy by heartbeat test, releasing",
-			c.topic, c.partID)
+		c.recordHealth(StatusHeartbeatExpired, "heartbeat expired",
+			consumerVelocity, partitionVelocity)
+		log.Warn("consumer unhealthy by heartbeat test, releasing", c.logFields()...)
+		c.noteHealth(true)
+		c.noteReleased()
+		c.lost(errors.New("heartbeat expired"))
 		go c.Release()
 		return false
 	}
 
 	// If the consumer group owning this claim is paused, we must release this claim.
 	if c.marshal.cluster.IsGroupPaused(c.marshal.GroupID()) {
-		log.Infof("[%s:%d] consumer group %s is paused, claim releasing",
-			c.topic, c.partID, c.marshal.GroupID())
+		c.recordHealth(StatusGroupPaused, "consumer group is paused",
+			consumerVelocity, partitionVelocity)
+		log.Info("consumer group is paused, claim releasing", c.logFields()...)
+		c.noteReleased()
 		go c.Release()
 		return false
 	}
 
+	if !c.judgeHealth(consumerVelocity, partitionVelocity) {
+		// Tell the consumer why now that we've dropped the lock, then release in a
+		// goroutine since it will involve calling out to Kafka.
+		c.noteHealth(true)
+		c.noteReleased()
+		go c.Release()
+		return false
+	}
+	return true
+}
+
+// judgeHealth runs the health policy against the claim and records the outcome. Returns
+// false if the claim should be released.
+func (c *claim) judgeHealth(consumerVelocity, partitionVelocity float64) bool {
 	// Take the lock below here as we are reading protected values on c and we're
 	// writing to c.cyclesBehind
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	// If we haven't seen any messages for more than a heartbeat interval, it's possible
-	// we've gotten into a bad state. Make a check to see how far behind we are, if we
-	// are behind and not seeing any messages then release.
-	if time.Now().After(c.lastMessageTime.Add(HeartbeatInterval * time.Second)) {
-		if consumerVelocity == 0 && (partitionVelocity > 0 || c.offsets.Latest > c.offsets.Current) {
-			// If that's true then it means velocity has been 0 for at least long enough
-			// to drive the average to 0, which means about 10 heartbeat cycles. This is
-			// long enough that releasing seems fine.
-			log.Warningf("[%s:%d] no messages received for %d seconds with CV=%0.2f PV=%0.2f, releasing",
-				c.topic, c.partID, HeartbeatInterval, consumerVelocity, partitionVelocity)
-			go c.Release()
-			return false
-		} else {
-			log.Infof("[%s:%d] no messages received for %d seconds with CV=%0.2f PV=%0.2f",
-				c.topic, c.partID, HeartbeatInterval, consumerVelocity, partitionVelocity)
-		}
-	}
+	inputs := c.healthInputs(consumerVelocity, partitionVelocity)
 
-	// In topic claim mode we don't do any velocity checking. It's up to the consumer
-	// to ensure they're claiming. TODO: Unclear if this is correct or not.
-	if c.options.ClaimEntireTopic || !c.options.ReleaseClaimsIfBehind {
+	// If we've been paused we're not consuming on purpose, so there's no point in judging
+	// our velocity. We stay healthy so that we keep heartbeating and hold on to the claim.
+	if c.Paused() {
+		c.cyclesBehind = 0
+		c.setHealth(StatusPaused, "paused", inputs)
 		return true
 	}
 
-	// We consider a consumer to be caught up if the predicted offset is past the end
-	// of the partition. This takes into account the fact that we only get offset information
-	// every hearbeat, so we could have some stale data.
-	testOffset := c.offsets.Current + int64(consumerVelocity*2)
-	if testOffset >= c.offsets.Latest {
+	// Likewise, if a rate limit has been holding us back we're meant to be slow.
+	if time.Since(c.throttledAt) < HeartbeatInterval*time.Second {
+		if c.offsets.Current < c.offsets.Latest {
+			log.Info("consumer is rate limited, staying healthy",
+				c.logFields("behind", c.offsets.Latest-c.offsets.Current)...)
+		}
 		c.cyclesBehind = 0
+		c.setHealth(StatusRateLimited, "rate limited", inputs)
 		return true
 	}
 
-	// At this point we know the consumer is NOT PRESENTLY caught up or predicted to catch
-	// up in the next two heartbeats.
+	// Everything else is up to the health policy
+	policy := c.options.HealthPolicy
+	if policy == nil {
+		policy = DefaultHealthPolicy{}
+	}
+	action, reason := policy.CheckHealth(inputs)
 
-	// If the consumer is moving as fast or faster than the partition and the consumer is
-	// at least moving, consider it healthy. This case is true in the standard catching
-	// up from behind case.
-	if partitionVelocity < consumerVelocity {
-		log.Infof("[%s:%d] consumer catching up: consume ∆ %0.2f >= produce ∆ %0.2f",
-			c.topic, c.partID, consumerVelocity, partitionVelocity)
+	switch action {
+	case HealthRelease:
+		c.cyclesBehind++
+		if consumerVelocity == 0 {
+			c.setHealth(StatusStalled, reason, inputs)
+		} else {
+			c.setHealth(StatusTooSlow, reason, inputs)
+		}
+		log.Warn("consumer unhealthy, releasing", c.logFields("reason", reason)...)
+		return false
+	case HealthWarn:
+		c.cyclesBehind++
+		c.setHealth(StatusTooSlow, reason, inputs)
+		log.Warn("consumer unhealthy", c.logFields("reason", reason,
+			"cycles_behind", c.cyclesBehind)...)
+	default:
 		c.cyclesBehind = 0
-		return true
+		c.noteHealth(false)
+		// Healthy, but more than two heartbeats of consumption from the end
+		if inputs.Lag() > int64(consumerVelocity*2) {
+			c.setHealth(StatusCatchingUp, reason, inputs)
+		} else {
+			c.setHealth(StatusHealthy, reason, inputs)
+		}
+		if reason != "" {
+			log.Info("consumer healthy", c.logFields("reason", reason)...)
+		}
 	}
+	return true
+}
 
-	// Unhealthy, so increase the cycle count so we know when it's been unhealthy for
-	// too long and we want to give it up
-	c.cyclesBehind++
+// healthInputs returns the state of this claim that the health policy judges. Must be
+// called with the lock held.
+func (c *claim) healthInputs(consumerVelocity, partitionVelocity float64) ClaimHealth {
+	return ClaimHealth{
+		Topic:               c.topic,
+		Partition:           c.partID,
+		Offsets:             c.offsets,
+		ConsumerVelocity:    consumerVelocity,
+		PartitionVelocity:   partitionVelocity,
+		OutstandingMessages: c.outstandingMessages,
+		LastMessageTime:     c.lastMessageTime,
+		CyclesBehind:        c.cyclesBehind,
+		ReleaseIfBehind:     !c.options.ClaimEntireTopic && c.options.ReleaseClaimsIfBehind,
+	}
+}
 
-	// If were behind by too many cycles, then we should try to release the
-	// partition. If so, do this in a goroutine since it will involve calling out
-	// to Kafka and releasing the partition.
-	if c.cyclesBehind >= 3 {
-		log.Warningf("[%s:%d] consumer unhealthy for too long, releasing",
-			c.topic, c.partID)
-		go c.Release()
-		return false
+// setHealth records the outcome of a health check. Must be called with the lock held.
+func (c *claim) setHealth(status HealthStatus, reason string, inputs ClaimHealth) {
+	c.health = ClaimStatus{
+		Topic:     c.topic,
+		Partition: c.partID,
+		Status:    status,
+		Reason:    reason,
+		Warnings:  c.cyclesBehind,
+		CheckedAt: time.Now(),
+		Inputs:    inputs,
 	}
+}
 
-	// Clearly we haven't been behind for long enough, so we're still "healthy"
-	log.Warningf("[%s:%d] consumer too slow: consume ∆ %0.2f < produce ∆ %0.2f (warning #%d)",
-		c.topic, c.partID, consumerVelocity, partitionVelocity, c.cyclesBehind)
-	return true
+// recordHealth is setHealth for when we don't hold the lock.
+func (c *claim) recordHealth(status HealthStatus, reason string,
+	consumerVelocity, partitionVelocity float64) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.setHealth(status, reason, c.healthInputs(consumerVelocity, partitionVelocity))
+}
+
+// noteHealth tells our consumer, if we have one, whether we passed our health check or
+// were released by it.
+func (c *claim) noteHealth(released bool) {
+	if c.consumer != nil {
+		c.consumer.noteHealth(c.topic, c.partID, released)
+	}
+}
+
+// noteReleased tells our consumer, if we have one, the health status that a health check
+// released us with. Must not be called with the lock held.
+func (c *claim) noteReleased() {
+	if c.consumer != nil {
+		c.consumer.noteReleased(c.healthStatus())
+	}
+}
+
+// healthStatus returns the outcome of our last health check.
+func (c *claim) healthStatus() ClaimStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.health.Status == "" {
+		return ClaimStatus{Topic: c.topic, Partition: c.partID, Status: StatusUnknown}
+	}
+	return c.health
 }
 
 // healthCheckLoop runs regularly and will perform a health check. Exits when this claim
@@ -562,22 +1656,23 @@ func (c *claim) healthCheckLoop() {
 		// give up.
 		for !c.heartbeatExpired() {
 			if err := c.updateOffsets(); err != nil {
-				log.Errorf("[%s:%d] health check loop failed to update offsets: %s",
-					c.topic, c.partID, err)
+				log.Error("health check loop failed to update offsets",
+					c.logFields("err", err)...)
 				time.Sleep(1 * time.Second)
 				continue
 			}
 			break
 		}
 
+		c.updateStuckOffset()
+
 		// Now healthcheck and, if it's good, heartbeat
 		if c.healthCheck() {
 			go c.heartbeat()
 		}
 		time.Sleep(<-c.marshal.cluster.jitters)
 	}
-	log.Infof("[%s:%d] health check loop exiting, claim terminated",
-		c.topic, c.partID)
+	log.Info("health check loop exiting, claim terminated", c.logFields()...)
 }
 
 // average returns the average of a given slice of int64s. It ignores 0s as
@@ -629,7 +1724,7 @@ func (c *claim) updateOffsets() error {
 	// Slow, hits Kafka. Run in a goroutine.
 	offsets, err := c.marshal.GetPartitionOffsets(c.topic, c.partID)
 	if err != nil {
-		log.Errorf("[%s:%d] failed to get offsets: %s", c.topic, c.partID, err)
+		log.Error("failed to get offsets", c.logFields("err", err)...)
 		return err
 	}
 
@@ -660,40 +1755,5 @@ func (c *claim) numTrackingOffsets() int {
 
 // PrintState outputs the status of the consumer.
 func (c *claim) PrintState() {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-
-	// "Claimed" status is from Marshal rationalizer, and "Terminated" status is from
-	// the local claim object (indicates we've exited somehow)
-	state := "----"
-	cl := c.marshal.GetPartitionClaim(c.topic, c.partID)
-	if cl.Claimed() {
-		if c.Terminated() {
-			state = "CL+T"
-		} else {
-			state = "CLMD"
-		}
-	} else if c.Terminated() {
-		state = "TERM"
-	}
-
-	ct := 0
-	for _, st := range c.tracking {
-		if st {
-			ct++
-		}
-	}
-
-	now := time.Now().Unix()
-
-	log.Infof("      * %2d [%s]: offsets %d <= %d <= %d | %d",
-		c.partID, state, c.offsets.Earliest, c.offsets.Current,
-		c.offsets.Latest, c.offsets.Committed)
-	log.Infof("                   BC %d | LHB %d (%d) | OM %d | CB %d",
-		c.beatCounter, c.lastHeartbeat, now-c.lastHeartbeat,
-		c.outstandingMessages, c.cyclesBehind)
-	log.Infof("                   TRACK COMMITTED %d | TRACK OUTSTANDING %d",
-		ct, len(c.tracking)-ct)
-	log.Infof("                   PV %0.2f | CV %0.2f",
-		c.PartitionVelocity(), c.ConsumerVelocity())
+	c.snapshot().printState()
 }
@@ -1,12 +1,15 @@
 package marshal
 
 import (
+	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	. "gopkg.in/check.v1"
 
+	"github.com/dropbox/kafka"
 	"github.com/dropbox/kafka/kafkatest"
 	"github.com/dropbox/kafka/proto"
 )
@@ -445,6 +448,441 @@ func (s *ClaimSuite) TestCommitOutstanding(c *C) {
 	c.Assert(s.cl.numTrackingOffsets(), Equals, 5)
 }
 
+func (s *ClaimSuite) TestNack(c *C) {
+	// Test that a nacked message is redelivered and holds back the offset until committed
+	s.cl.options.NackBackoffMin = 10 * time.Millisecond
+	s.cl.options.NackBackoffMax = 20 * time.Millisecond
+	c.Assert(s.Produce("test3", 0, "m1", "m2"), Equals, int64(1))
+
+	msg1 := s.consumeOne(c)
+	c.Assert(msg1.Value, DeepEquals, []byte("m1"))
+	msg2 := s.consumeOne(c)
+	c.Assert(msg2.Value, DeepEquals, []byte("m2"))
+	c.Assert(s.cl.Commit(msg2.Offset), IsNil)
+
+	// Nack #1, it should come back around. Nacking again before then is an error, so it
+	// only comes back once.
+	c.Assert(s.cl.Nack(msg1, 100*time.Millisecond), IsNil)
+	c.Assert(s.cl.Nack(msg1, 0), NotNil)
+	msg1 = s.consumeOne(c)
+	c.Assert(msg1.Offset, Equals, int64(0))
+	c.Assert(msg1.DeliveryAttempt, Equals, 2)
+	s.cl.lock.RLock()
+	c.Assert(s.cl.deliveries[0].attempts, Equals, 2)
+	s.cl.lock.RUnlock()
+
+	// Offset can't move past the nacked message
+	c.Assert(s.cl.Flush(), IsNil)
+	c.Assert(s.cl.offsets.Current, Equals, int64(0))
+
+	// Now commit it and the offset advances past both
+	c.Assert(s.cl.Commit(msg1.Offset), IsNil)
+	c.Assert(s.cl.Flush(), IsNil)
+	c.Assert(s.cl.offsets.Current, Equals, int64(2))
+
+	// Nacking a committed or unknown offset is an error
+	c.Assert(s.cl.Nack(msg1, 0), NotNil)
+	msg1.Offset = 95
+	c.Assert(s.cl.Nack(msg1, 0), NotNil)
+}
+
+func (s *ClaimSuite) TestNackBackoff(c *C) {
+	s.cl.options.NackBackoffMin = time.Second
+	s.cl.options.NackBackoffMax = 3 * time.Second
+	c.Assert(s.cl.nackBackoff(1), Equals, time.Second)
+	c.Assert(s.cl.nackBackoff(2), Equals, 2*time.Second)
+	c.Assert(s.cl.nackBackoff(3), Equals, 3*time.Second)
+
+	// No maximum means no cap
+	s.cl.options.NackBackoffMax = 0
+	c.Assert(s.cl.nackBackoff(4), Equals, 8*time.Second)
+}
+
+func (s *ClaimSuite) TestNackDeadLetter(c *C) {
+	// Test that a message that runs out of attempts goes to the dead-letter topic
+	// and is then committed
+	s.s.ResetTopic("test1")
+	MakeTopic(s.s, "test1", 1)
+	s.cl.options.NackBackoffMin = 0
+	s.cl.options.MaxDeliveryAttempts = 2
+	s.cl.options.DeadLetterTopic = "test1"
+	c.Assert(s.Produce("test3", 0, "m1"), Equals, int64(0))
+
+	msg1 := s.consumeOne(c)
+	c.Assert(s.cl.Nack(msg1, 0), IsNil)
+	msg1 = s.consumeOne(c)
+	c.Assert(msg1.Value, DeepEquals, []byte("m1"))
+
+	// Second nack exhausts our attempts
+	c.Assert(s.cl.Nack(msg1, 0), IsNil)
+	latest, err := s.m.cluster.broker.OffsetLatest("test1", 0)
+	c.Assert(err, IsNil)
+	c.Assert(latest, Equals, int64(1))
+	c.Assert(s.cl.Flush(), IsNil)
+
+	// The dead-lettered message says where it came from
+	conf := kafka.NewConsumerConf("test1", 0)
+	conf.StartOffset = 0
+	kc, err := s.m.cluster.broker.Consumer(conf)
+	c.Assert(err, IsNil)
+	dead, err := kc.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(dead.Value, DeepEquals, []byte("m1"))
+	dl, err := ParseDeadLetterKey(dead.Key)
+	c.Assert(err, IsNil)
+	c.Assert(dl, DeepEquals, DeadLetter{Topic: "test3", Partition: 0, Offset: 0, Attempts: 2})
+	c.Assert(s.cl.offsets.Current, Equals, int64(1))
+	c.Assert(s.cl.numTrackingOffsets(), Equals, 0)
+
+	// Unknown dead-letter topics leave the message outstanding
+	c.Assert(s.Produce("test3", 0, "m2"), Equals, int64(1))
+	s.cl.options.MaxDeliveryAttempts = 1
+	s.cl.options.DeadLetterTopic = "nonexistent"
+	msg2 := s.consumeOne(c)
+	c.Assert(s.cl.Nack(msg2, 0), NotNil)
+	c.Assert(s.cl.numTrackingOffsets(), Equals, 1)
+
+	// A message from before the claim moved is neither dead-lettered nor committed
+	s.cl.options.DeadLetterTopic = "test1"
+	s.cl.lock.Lock()
+	s.cl.epoch++
+	s.cl.lock.Unlock()
+	c.Assert(s.cl.retry(msg2, 1, 0), NotNil)
+	latest, err = s.m.cluster.broker.OffsetLatest("test1", 0)
+	c.Assert(err, IsNil)
+	c.Assert(latest, Equals, int64(1))
+	s.cl.lock.RLock()
+	c.Assert(s.cl.tracking[msg2.Offset], Equals, false)
+	s.cl.lock.RUnlock()
+}
+
+func (s *ClaimSuite) TestVisibilityTimeout(c *C) {
+	// Test that a message which isn't committed in time is redelivered
+	s.cl.lock.Lock()
+	s.cl.options.VisibilityTimeout = 200 * time.Millisecond
+	s.cl.options.NackBackoffMin = 0
+	s.cl.lock.Unlock()
+	go s.cl.visibilityLoop()
+	c.Assert(s.Produce("test3", 0, "m1"), Equals, int64(0))
+
+	msg1 := s.consumeOne(c)
+	c.Assert(msg1.DeliveryAttempt, Equals, 1)
+
+	// Don't commit, it should come back with a higher attempt count
+	msg1 = s.consumeOne(c)
+	c.Assert(msg1.Offset, Equals, int64(0))
+	c.Assert(msg1.DeliveryAttempt, Equals, 2)
+
+	// Once committed it stays gone
+	c.Assert(s.cl.Commit(msg1.Offset), IsNil)
+	select {
+	case msg := <-s.ch:
+		c.Errorf("Unexpected redelivery of offset %d", msg.Offset)
+	case <-time.After(500 * time.Millisecond):
+	}
+	c.Assert(s.cl.Flush(), IsNil)
+	c.Assert(s.cl.offsets.Current, Equals, int64(1))
+}
+
+func (s *ClaimSuite) TestOutstandingOffset(c *C) {
+	// Test that we can find the offset holding back the partition and get told about it
+	stuck := make(chan OutstandingOffset, 1)
+	s.cl.options.StuckOffsetHeartbeats = 2
+	s.cl.options.StuckOffsetHandler = func(oo OutstandingOffset) { stuck <- oo }
+
+	_, ok := s.cl.OutstandingOffset()
+	c.Assert(ok, Equals, false)
+
+	c.Assert(s.Produce("test3", 0, "m1", "m2", "m3"), Equals, int64(2))
+	s.consumeOne(c)
+	c.Assert(s.cl.Commit(s.consumeOne(c).Offset), IsNil)
+	c.Assert(s.cl.Commit(s.consumeOne(c).Offset), IsNil)
+
+	oo, ok := s.cl.OutstandingOffset()
+	c.Assert(ok, Equals, true)
+	c.Assert(oo.Topic, Equals, "test3")
+	c.Assert(oo.Offset, Equals, int64(0))
+	c.Assert(oo.Blocked, Equals, 2)
+	c.Assert(oo.Heartbeats, Equals, 0)
+
+	// First heartbeat counts but doesn't alert, second one does
+	s.cl.updateStuckOffset()
+	select {
+	case <-stuck:
+		c.Error("Stuck offset reported too early.")
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.cl.updateStuckOffset()
+	select {
+	case oo = <-stuck:
+		c.Assert(oo.Offset, Equals, int64(0))
+		c.Assert(oo.Heartbeats, Equals, 2)
+	case <-time.After(3 * time.Second):
+		c.Error("Stuck offset never reported.")
+	}
+}
+
+// memoryOffsetStore is an OffsetStore for testing.
+type memoryOffsetStore struct {
+	lock    sync.Mutex
+	offsets map[string]int64
+}
+
+func (m *memoryOffsetStore) key(groupID, topicName string, partID int) string {
+	return fmt.Sprintf("%s/%s/%d", groupID, topicName, partID)
+}
+
+func (m *memoryOffsetStore) Load(groupID, topicName string, partID int) (int64, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	offset, ok := m.offsets[m.key(groupID, topicName, partID)]
+	return offset, ok, nil
+}
+
+func (m *memoryOffsetStore) Save(groupID, topicName string, partID int, offset int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.offsets[m.key(groupID, topicName, partID)] = offset
+	return nil
+}
+
+func (s *ClaimSuite) TestOffsetStore(c *C) {
+	// Test that a claim starts from the offset store if it has an offset, and that
+	// CommitTx hands out safe offsets to record
+	store := &memoryOffsetStore{offsets: make(map[string]int64)}
+	c.Assert(store.Save(s.m.GroupID(), "test3", 1, 2), IsNil)
+	c.Assert(s.Produce("test3", 1, "m1", "m2", "m3", "m4", "m5"), Equals, int64(4))
+
+	opts := NewConsumerOptions()
+	opts.OffsetStore = store
+	ch := make(chan *Message, 10)
+	cl := newClaim("test3", 1, s.m, nil, ch, opts)
+	c.Assert(cl, NotNil)
+	defer cl.Release()
+	c.Assert(cl.offsets.Current, Equals, int64(2))
+
+	msgs := make([]*Message, 3)
+	for i := range msgs {
+		select {
+		case msgs[i] = <-ch:
+		case <-time.After(3 * time.Second):
+			c.Fatal("Timed out consuming a message.")
+		}
+	}
+	c.Assert(msgs[0].Value, DeepEquals, []byte("m3"))
+
+	// Commit out of order, the hook should only ever see the oldest uncommitted offset
+	save := func(offset int64) error {
+		return store.Save(s.m.GroupID(), "test3", 1, offset)
+	}
+	c.Assert(cl.CommitTx(msgs[1], save), IsNil)
+	offset, _, _ := store.Load(s.m.GroupID(), "test3", 1)
+	c.Assert(offset, Equals, int64(2))
+	c.Assert(cl.CommitTx(msgs[0], save), IsNil)
+	offset, _, _ = store.Load(s.m.GroupID(), "test3", 1)
+	c.Assert(offset, Equals, int64(4))
+	c.Assert(cl.CommitTx(msgs[2], save), IsNil)
+	offset, _, _ = store.Load(s.m.GroupID(), "test3", 1)
+	c.Assert(offset, Equals, int64(5))
+
+	// Committing again doesn't run the hook or count the message twice
+	c.Assert(cl.CommitTx(msgs[2], func(int64) error {
+		c.Error("hook ran for a committed message")
+		return nil
+	}), NotNil)
+	cl.lock.RLock()
+	c.Assert(cl.outstandingMessages, Equals, 0)
+	cl.lock.RUnlock()
+
+	// Nor does committing a message from before the claim was moved
+	stale := *msgs[2]
+	stale.epoch++
+	c.Assert(cl.CommitTx(&stale, func(int64) error {
+		c.Error("hook ran for a stale message")
+		return nil
+	}), NotNil)
+
+	// A failing hook leaves the message uncommitted
+	c.Assert(s.Produce("test3", 1, "m6"), Equals, int64(5))
+	var msg6 *Message
+	select {
+	case msg6 = <-ch:
+	case <-time.After(3 * time.Second):
+		c.Fatal("Timed out consuming a message.")
+	}
+	c.Assert(cl.CommitTx(msg6, func(int64) error { return errors.New("boom") }), NotNil)
+	c.Assert(cl.Flush(), IsNil)
+	c.Assert(cl.offsets.Current, Equals, int64(5))
+}
+
+func (s *ClaimSuite) TestInitialOffset(c *C) {
+	// Test that partitions without any recorded offset start where we ask them to
+	c.Assert(s.Produce("test3", 1, "m1", "m2", "m3", "m4", "m5"), Equals, int64(4))
+	c.Assert(s.Produce("test3", 2, "m1", "m2", "m3", "m4", "m5"), Equals, int64(4))
+
+	opts := NewConsumerOptions()
+	opts.InitialOffset = InitialOffsetLatest
+	cl := newClaim("test3", 1, s.m, nil, make(chan *Message, 10), opts)
+	c.Assert(cl, NotNil)
+	defer cl.Release()
+	c.Assert(cl.offsets.Current, Equals, int64(5))
+	c.Assert(cl.offsetSource, Equals, "initial latest")
+
+	opts.InitialOffset = InitialOffsetBeforeLatest
+	opts.InitialOffsetCount = 2
+	cl2 := newClaim("test3", 2, s.m, nil, make(chan *Message, 10), opts)
+	c.Assert(cl2, NotNil)
+	defer cl2.Release()
+	c.Assert(cl2.offsets.Current, Equals, int64(3))
+
+	// Asking for more than exists gives us the earliest
+	offsets := PartitionOffsets{Earliest: 2, Latest: 5}
+	c.Assert(InitialOffsetBeforeLatest.offset(offsets, 10), Equals, int64(2))
+	c.Assert(InitialOffsetEarliest.offset(offsets, 10), Equals, int64(2))
+}
+
+func (s *ClaimSuite) TestOffsetOutOfRange(c *C) {
+	// Test that a claim whose offset is out of range recovers according to the policy;
+	// we use the offset store to start the claims past the end of the partition
+	store := &memoryOffsetStore{offsets: make(map[string]int64)}
+	c.Assert(store.Save(s.m.GroupID(), "test3", 1, 100), IsNil)
+	c.Assert(store.Save(s.m.GroupID(), "test3", 2, 100), IsNil)
+	c.Assert(s.Produce("test3", 1, "m1", "m2"), Equals, int64(1))
+	c.Assert(s.Produce("test3", 2, "m1", "m2"), Equals, int64(1))
+
+	opts := NewConsumerOptions()
+	opts.OffsetStore = store
+	opts.OffsetOutOfRangePolicy = OffsetOutOfRangeResetEarliest
+	ch := make(chan *Message, 10)
+	cl := newClaim("test3", 1, s.m, nil, ch, opts)
+	c.Assert(cl, NotNil)
+	defer cl.Release()
+	select {
+	case msg := <-ch:
+		c.Assert(msg.Value, DeepEquals, []byte("m1"))
+	case <-time.After(3 * time.Second):
+		c.Fatal("Timed out consuming a message.")
+	}
+	c.Assert(cl.Terminated(), Equals, false)
+
+	// The callback gets to pick, and the reset position is heartbeated
+	called := make(chan int64, 1)
+	opts.OffsetOutOfRangePolicy = OffsetOutOfRangeCallback
+	opts.OffsetOutOfRangeHandler = func(topicName string, partID int, offset int64,
+		offsets PartitionOffsets) OffsetOutOfRangePolicy {
+		called <- offset
+		return OffsetOutOfRangeResetLatest
+	}
+	cl2 := newClaim("test3", 2, s.m, nil, make(chan *Message, 10), opts)
+	c.Assert(cl2, NotNil)
+	defer cl2.Release()
+	select {
+	case offset := <-called:
+		c.Assert(offset, Equals, int64(100))
+	case <-time.After(3 * time.Second):
+		c.Fatal("Out of range handler never called.")
+	}
+	for i := 0; i < 100 && s.m.GetPartitionClaim("test3", 2).CurrentOffset != 2; i++ {
+		time.Sleep(30 * time.Millisecond)
+	}
+	c.Assert(s.m.GetPartitionClaim("test3", 2).CurrentOffset, Equals, int64(2))
+	c.Assert(cl2.Terminated(), Equals, false)
+}
+
+func (s *ClaimSuite) TestPause(c *C) {
+	// While paused nothing is fetched, but we stay healthy even though we're behind
+	// and keep heartbeating
+	s.cl.Pause()
+	c.Assert(s.cl.Paused(), Equals, true)
+	c.Assert(s.Produce("test3", 0, "m1", "m2"), Equals, int64(1))
+	select {
+	case <-s.ch:
+		c.Fatal("Received message while paused.")
+	case <-time.After(500 * time.Millisecond):
+	}
+	s.cl.offsets.Latest = 2
+	s.cl.offsetLatestHistory = [10]int64{1, 2, 0, 0, 0, 0, 0, 0, 0, 0}
+	s.cl.lastMessageTime = time.Now().Add(-2 * HeartbeatInterval * time.Second)
+	c.Assert(s.cl.healthCheck(), Equals, true)
+	c.Assert(s.cl.cyclesBehind, Equals, 0)
+	c.Assert(s.cl.heartbeat(), Equals, true)
+	c.Assert(s.cl.Terminated(), Equals, false)
+
+	// Resuming starts the flow again and forgets the velocity history
+	s.cl.Resume()
+	c.Assert(s.cl.Paused(), Equals, false)
+	c.Assert(s.cl.offsetLatestHistory, Equals, [10]int64{})
+	c.Assert(s.consumeOne(c).Value, DeepEquals, []byte("m1"))
+	c.Assert(s.consumeOne(c).Value, DeepEquals, []byte("m2"))
+}
+
+func (s *ClaimSuite) TestRateLimit(c *C) {
+	// With a limit of one message per second the second message is held back, and
+	// falling behind because of that doesn't count against us
+	c.Assert(s.Produce("test3", 1, "m1", "m2", "m3"), Equals, int64(2))
+	opts := NewConsumerOptions()
+	opts.PartitionRateLimit = RateLimit{MessagesPerSecond: 1}
+	ch := make(chan *Message, 10)
+	cl := newClaim("test3", 1, s.m, nil, ch, opts)
+	c.Assert(cl, NotNil)
+	defer cl.Release()
+
+	select {
+	case msg := <-ch:
+		c.Assert(msg.Value, DeepEquals, []byte("m1"))
+	case <-time.After(3 * time.Second):
+		c.Fatal("Timed out consuming a message.")
+	}
+	select {
+	case <-ch:
+		c.Fatal("Rate limit not enforced.")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	cl.lock.Lock()
+	c.Assert(cl.throttledAt.IsZero(), Equals, false)
+	cl.offsets.Latest = 3
+	cl.offsetLatestHistory = [10]int64{1, 2, 3, 0, 0, 0, 0, 0, 0, 0}
+	cl.cyclesBehind = 2
+	cl.lock.Unlock()
+	c.Assert(cl.healthCheck(), Equals, true)
+	c.Assert(cl.cyclesBehind, Equals, 0)
+}
+
+func (s *ClaimSuite) TestCommitAsync(c *C) {
+	// Futures resolve once a heartbeat covers their offset, which requires everything
+	// before them to have been committed too
+	c.Assert(s.Produce("test3", 0, "m1", "m2", "m3"), Equals, int64(2))
+	msg1, msg2, msg3 := s.consumeOne(c), s.consumeOne(c), s.consumeOne(c)
+	f2 := s.cl.commitAsync(msg2)
+	c.Assert(s.cl.updateOffsets(), IsNil)
+	c.Assert(s.cl.heartbeat(), Equals, true)
+	select {
+	case <-f2.Done():
+		c.Fatal("Future resolved before its offset was recorded.")
+	default:
+	}
+
+	f1 := s.cl.commitAsync(msg1)
+	c.Assert(s.cl.updateOffsets(), IsNil)
+	c.Assert(s.cl.heartbeat(), Equals, true)
+	c.Assert(f1.Wait(), IsNil)
+	c.Assert(f2.Wait(), IsNil)
+	c.Assert(s.m.GetPartitionClaim("test3", 0).CurrentOffset, Equals, int64(2))
+
+	// Committing a bogus offset fails straight away, and terminating records whatever
+	// is still pending
+	c.Assert(s.cl.commitAsync(&Message{Message: proto.Message{Offset: 95}}).Wait(), NotNil)
+	f3 := s.cl.commitAsync(msg3)
+	s.cl.lock.Lock()
+	c.Assert(len(s.cl.pendingCommits), Equals, 1)
+	s.cl.lock.Unlock()
+	c.Assert(s.cl.Terminate(), Equals, true)
+	c.Assert(f3.Wait(), IsNil)
+}
+
 func (s *ClaimSuite) TestCurrentLag(c *C) {
 	// Test that GetCurrentLag returns the correct numbers in various cases
 	s.cl.offsets.Current = 0
@@ -464,6 +902,24 @@ func (s *ClaimSuite) TestCurrentLag(c *C) {
 	c.Assert(s.cl.GetCurrentLag(), Equals, int64(1))
 }
 
+func (s *ClaimSuite) TestTimeLag(c *C) {
+	// Producing 2 and consuming 3 messages per heartbeat
+	s.cl.offsetCurrentHistory = [10]int64{1, 4, 7, 10, 13, 16, 19, 22, 25, 28}
+	s.cl.offsetLatestHistory = [10]int64{31, 33, 35, 37, 39, 41, 43, 45, 47, 49}
+	s.cl.offsets.Current = 28
+	s.cl.offsets.Latest = 49
+
+	tl := s.cl.timeLag()
+	c.Assert(tl.Lag, Equals, int64(21))
+	c.Assert(tl.Behind, Equals, time.Duration(10.5*float64(HeartbeatInterval*time.Second)))
+	c.Assert(tl.CatchingUp, Equals, true)
+	c.Assert(tl.CatchUp, Equals, 21*HeartbeatInterval*time.Second)
+
+	snap := s.cl.snapshot()
+	c.Assert(snap.SecondsBehind, Equals, tl.Behind.Seconds())
+	c.Assert(snap.CatchUpSeconds, Equals, tl.CatchUp.Seconds())
+}
+
 func (s *ClaimSuite) TestHeartbeat(c *C) {
 	// Ensure that our heartbeats are updating the marshal structures appropriately
 	// (makes sure clients are seeing the right values)
@@ -671,6 +1127,56 @@ func (s *ClaimSuite) TestHealthCheck(c *C) {
 	c.Assert(s.cl.healthCheck(), Equals, true)
 }
 
+func (s *ClaimSuite) TestHealthPolicy(c *C) {
+	// A lag based policy doesn't care that we're consuming as fast as the partition
+	s.cl.options.HealthPolicy = LagThresholdPolicy{MaxLag: 5, Cycles: 2}
+	s.cl.offsetCurrentHistory = [10]int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	s.cl.offsetLatestHistory = [10]int64{11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	s.cl.offsets.Current = 10
+	s.cl.offsets.Latest = 14
+	c.Assert(s.cl.healthCheck(), Equals, true)
+	c.Assert(s.cl.cyclesBehind, Equals, 0)
+
+	// Over the threshold we warn once, then release
+	s.cl.offsets.Latest = 20
+	c.Assert(s.cl.healthCheck(), Equals, true)
+	c.Assert(s.cl.cyclesBehind, Equals, 1)
+	c.Assert(s.cl.healthCheck(), Equals, false)
+	c.Assert(s.m.cluster.waitForRsteps(3), Equals, 3)
+	c.Assert(s.m.GetPartitionClaim("test3", 0).LastHeartbeat, Equals, int64(0))
+}
+
+func (s *ClaimSuite) TestHealthStatus(c *C) {
+	c.Assert(s.cl.healthStatus().Status, Equals, StatusUnknown)
+
+	// Behind, but within what the policy allows
+	s.cl.options.HealthPolicy = LagThresholdPolicy{MaxLag: 5, Cycles: 2}
+	s.cl.offsetCurrentHistory = [10]int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	s.cl.offsetLatestHistory = [10]int64{11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	s.cl.offsets.Current = 10
+	s.cl.offsets.Latest = 14
+	c.Assert(s.cl.healthCheck(), Equals, true)
+	status := s.cl.healthStatus()
+	c.Assert(status.Status, Equals, StatusCatchingUp)
+	c.Assert(status.Inputs.Lag(), Equals, int64(4))
+	c.Assert(status.Inputs.ConsumerVelocity, Equals, float64(1))
+
+	// Caught up
+	s.cl.offsets.Latest = 11
+	c.Assert(s.cl.healthCheck(), Equals, true)
+	c.Assert(s.cl.healthStatus().Status, Equals, StatusHealthy)
+
+	// Too slow, then released
+	s.cl.offsets.Latest = 20
+	c.Assert(s.cl.healthCheck(), Equals, true)
+	status = s.cl.healthStatus()
+	c.Assert(status.Status, Equals, StatusTooSlow)
+	c.Assert(status.Warnings, Equals, 1)
+	c.Assert(status.Reason, Equals, "lag of 10 messages exceeds 5")
+	c.Assert(s.cl.healthCheck(), Equals, false)
+	c.Assert(s.cl.healthStatus().Warnings, Equals, 2)
+}
+
 func (s *ClaimSuite) TestHealthCheckRelease(c *C) {
 	// Test that an expired heartbeat causes the partition to get immediately released
 	s.cl.lastHeartbeat -= HeartbeatInterval * 2
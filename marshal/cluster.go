@@ -34,6 +34,7 @@ type KafkaCluster struct {
 	partitions int
 	jitters    chan time.Duration
 	options    MarshalOptions
+	metrics    *metricsRegistry
 
 	// Lock protects the following members; you must have this lock in order to
 	// read from or write to these.
@@ -43,6 +44,8 @@ type KafkaCluster struct {
 	groups     map[string]map[string]*topicState
 	// pausedGroups stores the expiry time for groups that are paused.
 	pausedGroups map[string]time.Time
+	// err is why we terminated, if it was because of an error.
+	err error
 
 	// This WaitGroup is used for signalling when all of the rationalizers have
 	// finished processing.
@@ -52,6 +55,12 @@ type KafkaCluster struct {
 	// used mainly by the test suite.
 	rsteps *int32
 
+	// rationalizerLock protects rationalizerState, the progress of the rationalizer of each
+	// Marshal topic partition. It's updated for every message we read, so it's kept apart
+	// from lock. It's never held while taking lock.
+	rationalizerLock  *sync.Mutex
+	rationalizerState map[int]RationalizerSnapshot
+
 	// This is for testing only. When this is non-zero, the rationalizer will answer
 	// queries based on THIS time instead of the current, actual time.
 	ts int64
@@ -97,10 +106,25 @@ type MarshalOptions struct {
 
 	// MaxMessageQueue is the number of messages to retrieve from Kafka and store in-memory
 	// waiting for consumption. This is per-Consumer and independent of message size so you
-	// should adjust this for your consumption patterns.
+	// should adjust this for your consumption patterns. Values below 1 are treated as 1,
+	// meaning messages are fetched one at a time as they're consumed.
 	//
 	// Default: 1000 messages.
 	MaxMessageQueue int
+
+	// MaxQueueBytes limits the total size (key plus value) of the messages each Consumer
+	// holds in memory waiting for consumption, in addition to MaxMessageQueue. When it's
+	// reached, fetching pauses until messages are consumed. A Consumer can override this
+	// with ConsumerOptions.MaxQueueBytes.
+	//
+	// Default: 0 (no limit).
+	MaxQueueBytes int64
+
+	// Tracer, if set, is told about our coordination operations such as claims, heartbeats
+	// and releases, so that they can be traced. See Tracer.
+	//
+	// Default: nil (no tracing).
+	Tracer Tracer
 }
 
 // NewMarshalOptions returns a set of MarshalOptions populated with defaults.
@@ -129,18 +153,21 @@ func Dial(name string, brokers []string, options MarshalOptions) (*KafkaCluster,
 	}
 
 	c := &KafkaCluster{
-		quit:          new(int32),
-		rsteps:        new(int32),
-		name:          name,
-		options:       options,
-		lock:          &sync.RWMutex{},
-		rationalizers: &sync.WaitGroup{},
-		broker:        broker,
-		producer:      broker.Producer(kafka.NewProducerConf()),
-		topics:        make(map[string]int),
-		groups:        make(map[string]map[string]*topicState),
-		pausedGroups:  make(map[string]time.Time),
-		jitters:       make(chan time.Duration, 100),
+		quit:              new(int32),
+		rsteps:            new(int32),
+		name:              name,
+		options:           options,
+		lock:              &sync.RWMutex{},
+		rationalizers:     &sync.WaitGroup{},
+		broker:            broker,
+		producer:          broker.Producer(kafka.NewProducerConf()),
+		topics:            make(map[string]int),
+		groups:            make(map[string]map[string]*topicState),
+		pausedGroups:      make(map[string]time.Time),
+		jitters:           make(chan time.Duration, 100),
+		rationalizerLock:  &sync.Mutex{},
+		rationalizerState: make(map[int]RationalizerSnapshot),
+		metrics:           newClusterMetrics(),
 		// It's important that marshalers begins as an empty slice and not nil to avoid
 		// a race between NewMarshaler and Terminate. See note in Terminate.
 		marshalers: make([]*Marshaler, 0),
@@ -183,22 +210,22 @@ func Dial(name string, brokers []string, options MarshalOptions) (*KafkaCluster,
 	go func() {
 		for !c.Terminated() {
 			time.Sleep(<-c.jitters)
-			log.Infof("[%s] Refreshing topic metadata.", c.name)
+			log.Info("refreshing topic metadata", "cluster", c.name)
 			c.refreshMetadata()
 
 			// See if the number of partitions in the marshal topic changed. This is bad if
 			// it happens, since it means we can no longer coordinate correctly.
 			if c.getTopicPartitions(MarshalTopic) != c.partitions {
-				log.Errorf("[%s] Marshal topic partition count changed. Terminating!", c.name)
-				c.Terminate()
+				log.Error("Marshal topic partition count changed, terminating", "cluster", c.name)
+				c.fail(errors.New("Marshal topic partition count changed"))
 			}
 		}
 	}()
 
 	// Wait for all rationalizers to come alive
-	log.Infof("[%s] Waiting for all rationalizers to come alive.", c.name)
+	log.Info("waiting for all rationalizers to come alive", "cluster", c.name)
 	c.rationalizers.Wait()
-	log.Infof("[%s] All rationalizers alive, KafkaCluster now alive.", c.name)
+	log.Info("all rationalizers alive, KafkaCluster now alive", "cluster", c.name)
 
 	return c, nil
 }
@@ -409,7 +436,8 @@ func (c *KafkaCluster) pauseConsumerGroup(groupID string, adminID string, expiry
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	log.Warningf("Cluster marking group %s paused with expiry: %s", groupID, expiry.Format(time.UnixDate))
+	log.Warn("cluster marking group paused", "cluster", c.name, "group", groupID,
+		"expiry", expiry.Format(time.UnixDate))
 	c.pausedGroups[groupID] = expiry
 }
 
@@ -432,7 +460,7 @@ func (c *KafkaCluster) Terminate() {
 		return
 	}
 
-	log.Infof("[%s] beginning termination", c.name)
+	log.Info("beginning termination", "cluster", c.name)
 
 	// This is a bit of a hack, but because marshaler.terminateAndCleanup requires the read lock
 	// on c, we can't terminate the Marshalers in the list while holding the write lock.
@@ -458,6 +486,26 @@ func (c *KafkaCluster) Terminate() {
 	go c.broker.Close()
 }
 
+// fail terminates the cluster because of an unrecoverable error. The error is passed on
+// to every Consumer.
+func (c *KafkaCluster) fail(err error) {
+	c.lock.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.lock.Unlock()
+
+	c.Terminate()
+}
+
+// terminationError returns the error given to fail, if any.
+func (c *KafkaCluster) terminationError() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.err
+}
+
 // Terminated returns whether or not we have been terminated.
 func (c *KafkaCluster) Terminated() bool {
 	return atomic.LoadInt32(c.quit) == 1
@@ -1,6 +1,8 @@
 package marshal
 
 import (
+	"fmt"
+
 	. "gopkg.in/check.v1"
 
 	"github.com/dropbox/kafka/kafkatest"
@@ -52,10 +54,12 @@ func (s *ClusterSuite) TestGetTopicState(c *C) {
 	c.Assert(topic, NotNil)
 	c.Assert(err, IsNil)
 
-	// And fail here
+	// And fail here, naming the holder as group/client
 	topic, err = s.m2.getClaimedPartitionState("test2", 0)
 	c.Assert(topic, IsNil)
 	c.Assert(err, NotNil)
+	c.Assert(err.(*FencedError).Reason, Equals,
+		fmt.Sprintf("claimed by %s/%s", s.m.groupID, s.m.clientID))
 
 	// And fail here (our group, diff partition)
 	topic, err = s.m.getClaimedPartitionState("test2", 1)
@@ -9,9 +9,12 @@
 package marshal
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,26 +24,294 @@ import (
 
 // CommitToken is a minimal structure that contains only the information necessary to
 // mark a message committed. This is done so that you can throw away the message instead
-// of holding on to it in memory.
+// of holding on to it in memory. Tokens can be serialized with MarshalBinary or as JSON
+// if the message is processed elsewhere.
+//
+// A token also records which claim the message was read under, so that it can't be
+// used to commit against a later claim of the same partition.
 type CommitToken struct {
-	topic  string
-	partID int
-	offset int64
+	topic   string
+	partID  int
+	offset  int64
+	claimID string
+	epoch   int
+}
+
+// commitTokenVersion is the first byte of a binary CommitToken.
+const commitTokenVersion byte = 1
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (t CommitToken) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, 1+len(t.topic)+len(t.claimID)+4*binary.MaxVarintLen64)
+	buf = append(buf, commitTokenVersion)
+
+	tmp := make([]byte, binary.MaxVarintLen64)
+	putString := func(s string) {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(s)))]...)
+		buf = append(buf, s...)
+	}
+	putInt := func(i int64) {
+		buf = append(buf, tmp[:binary.PutVarint(tmp, i)]...)
+	}
+	putString(t.topic)
+	putInt(int64(t.partID))
+	putInt(t.offset)
+	putString(t.claimID)
+	putInt(int64(t.epoch))
+	return buf, nil
 }
 
-// Message is a container for Kafka messages.
-type Message proto.Message
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (t *CommitToken) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || data[0] != commitTokenVersion {
+		return errors.New("CommitToken: unknown encoding")
+	}
+	data = data[1:]
+
+	var err error
+	getInt := func() int64 {
+		val, n := binary.Varint(data)
+		if n <= 0 {
+			err = errors.New("CommitToken: truncated data")
+			return 0
+		}
+		data = data[n:]
+		return val
+	}
+	getString := func() string {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			err = errors.New("CommitToken: truncated data")
+			return ""
+		}
+		val := string(data[n : n+int(length)])
+		data = data[n+int(length):]
+		return val
+	}
+
+	var tmp CommitToken
+	if tmp.topic = getString(); err != nil {
+		return err
+	}
+	if tmp.partID = int(getInt()); err != nil {
+		return err
+	}
+	if tmp.offset = getInt(); err != nil {
+		return err
+	}
+	if tmp.claimID = getString(); err != nil {
+		return err
+	}
+	if tmp.epoch = int(getInt()); err != nil {
+		return err
+	}
+	if len(data) != 0 {
+		return errors.New("CommitToken: trailing data")
+	}
+	*t = tmp
+	return nil
+}
+
+// commitTokenJSON is the JSON form of a CommitToken.
+type commitTokenJSON struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Claim     string `json:"claim"`
+	Epoch     int    `json:"epoch"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (t CommitToken) MarshalJSON() ([]byte, error) {
+	return json.Marshal(commitTokenJSON{
+		Topic:     t.topic,
+		Partition: t.partID,
+		Offset:    t.offset,
+		Claim:     t.claimID,
+		Epoch:     t.epoch,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *CommitToken) UnmarshalJSON(data []byte) error {
+	var tmp commitTokenJSON
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	*t = CommitToken{
+		topic:   tmp.Topic,
+		partID:  tmp.Partition,
+		offset:  tmp.Offset,
+		claimID: tmp.Claim,
+		epoch:   tmp.Epoch,
+	}
+	return nil
+}
+
+// Message is a container for Kafka messages. It embeds the proto.Message it was read as;
+// use &msg.Message where a *proto.Message is needed.
+type Message struct {
+	proto.Message
+
+	// DeliveryAttempt is 1 the first time a message is delivered and goes up by one
+	// every time it is redelivered, either by Nack or by the VisibilityTimeout expiring.
+	DeliveryAttempt int
+
+	// claimID and epoch identify the claim this message was read under and its position
+	// at the time, see claim.id and claim.epoch.
+	claimID string
+	epoch   int
+}
 
 // CommitToken returns a CommitToken for a message. This can be passed to the
 // CommitByToken method.
 func (m *Message) CommitToken() CommitToken {
 	return CommitToken{
-		topic:  m.Topic,
-		partID: int(m.Partition),
-		offset: m.Offset,
+		topic:   m.Topic,
+		partID:  int(m.Partition),
+		offset:  m.Offset,
+		claimID: m.claimID,
+		epoch:   m.epoch,
 	}
 }
 
+// errorsChanSize is how many errors the Errors channel holds before we start dropping them.
+const errorsChanSize = 100
+
+// ErrConsumerTerminated is returned by Consumer.Err after the consumer has been terminated
+// normally.
+var ErrConsumerTerminated = errors.New("Consumer has been terminated.")
+
+// ClaimLostError is sent on Consumer.Errors when we give up a partition claim because
+// something went wrong, e.g. a heartbeat failed or the offset we were consuming is gone.
+// The consumer keeps running and may claim the partition again later.
+type ClaimLostError struct {
+	Topic     string
+	Partition int
+	Err       error
+}
+
+func (e *ClaimLostError) Error() string {
+	return fmt.Sprintf("Lost claim on %s:%d: %s", e.Topic, e.Partition, e.Err)
+}
+
+// VisibilityTimeoutError is sent on Consumer.Errors when a message wasn't committed within
+// ConsumerOptions.VisibilityTimeout and is being redelivered. Attempt is the delivery
+// attempt that timed out. The consumer carries on.
+type VisibilityTimeoutError struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Attempt   int
+	Timeout   time.Duration
+}
+
+func (e *VisibilityTimeoutError) Error() string {
+	return fmt.Sprintf("Offset %d of %s:%d not committed within %s (attempt %d)",
+		e.Offset, e.Topic, e.Partition, e.Timeout, e.Attempt)
+}
+
+// FencedError means that a partition we thought we held is owned by somebody else, so we
+// can't safely carry on with it. When the consumer's own state is inconsistent (an
+// internal double-claim) the consumer terminates with this error.
+type FencedError struct {
+	Topic     string
+	Partition int
+	Reason    string
+}
+
+func (e *FencedError) Error() string {
+	return fmt.Sprintf("Fenced from %s:%d: %s", e.Topic, e.Partition, e.Reason)
+}
+
+// ClusterTerminatedError means the consumer stopped because its KafkaCluster hit an error
+// it can't recover from, such as the Marshal topic changing.
+type ClusterTerminatedError struct {
+	Err error
+}
+
+func (e *ClusterTerminatedError) Error() string {
+	return fmt.Sprintf("Cluster terminated: %s", e.Err)
+}
+
+// InitialOffset selects where a consumer starts reading a partition that has never been
+// consumed by its group, i.e. one with neither a Marshal nor a Kafka committed offset.
+type InitialOffset int
+
+const (
+	// InitialOffsetEarliest starts at the oldest message still in the partition. This
+	// is the default.
+	InitialOffsetEarliest InitialOffset = iota
+
+	// InitialOffsetLatest starts with the next message produced to the partition.
+	InitialOffsetLatest
+
+	// InitialOffsetBeforeLatest starts InitialOffsetCount messages before the latest
+	// offset (or at the earliest, if the partition doesn't have that many).
+	InitialOffsetBeforeLatest
+)
+
+// String returns a human readable name for the policy.
+func (i InitialOffset) String() string {
+	switch i {
+	case InitialOffsetEarliest:
+		return "earliest"
+	case InitialOffsetLatest:
+		return "latest"
+	case InitialOffsetBeforeLatest:
+		return "before-latest"
+	}
+	return fmt.Sprintf("InitialOffset(%d)", int(i))
+}
+
+// offset calculates the starting offset for a partition given its current offsets.
+func (i InitialOffset) offset(offsets PartitionOffsets, count int64) int64 {
+	switch i {
+	case InitialOffsetLatest:
+		return offsets.Latest
+	case InitialOffsetBeforeLatest:
+		if offsets.Latest-count > offsets.Earliest {
+			return offsets.Latest - count
+		}
+	}
+	return offsets.Earliest
+}
+
+// OffsetOutOfRangePolicy decides what a claim does when the offset it is consuming is no
+// longer available in Kafka, usually because retention deleted it before we got there.
+type OffsetOutOfRangePolicy int
+
+const (
+	// OffsetOutOfRangeRelease releases the partition so somebody else can try. This is
+	// the default.
+	OffsetOutOfRangeRelease OffsetOutOfRangePolicy = iota
+
+	// OffsetOutOfRangeResetEarliest continues from the oldest offset still available.
+	OffsetOutOfRangeResetEarliest
+
+	// OffsetOutOfRangeResetLatest continues from the newest offset, skipping everything
+	// currently in the partition.
+	OffsetOutOfRangeResetLatest
+
+	// OffsetOutOfRangeCallback asks the OffsetOutOfRangeHandler which of the other
+	// policies to use.
+	OffsetOutOfRangeCallback
+)
+
+// OffsetReset records a claim being moved to a new offset because the one it was
+// consuming fell out of range. If To is greater than From, the messages in between
+// were never consumed.
+type OffsetReset struct {
+	Topic  string
+	PartID int
+	From   int64
+	To     int64
+	Time   time.Time
+}
+
+// maxOffsetResets is how many OffsetResets a Consumer remembers.
+const maxOffsetResets = 100
+
 // ConsumerOptions represents all of the options that a consumer can be configured with.
 type ConsumerOptions struct {
 	// FastReclaim instructs the consumer to attempt to reclaim any partitions
@@ -69,6 +340,16 @@ type ConsumerOptions struct {
 	// is consuming at a rate slower than the partition is being produced to.
 	ReleaseClaimsIfBehind bool
 
+	// HealthPolicy decides, once per heartbeat, whether each claim is healthy or should be
+	// released. See LagThresholdPolicy and TimeLagPolicy for alternatives to the default.
+	// Default: nil, meaning DefaultHealthPolicy.
+	HealthPolicy HealthPolicy
+
+	// ReclaimPolicy decides how long to wait after releasing a partition before claiming it
+	// again. See BackoffReclaimPolicy and AloneReclaimPolicy for alternatives to the default.
+	// Default: nil, meaning CooldownReclaimPolicy with a cooldown of one heartbeat interval.
+	ReclaimPolicy ReclaimPolicy
+
 	// The maximum number of claims this Consumer is allowed to hold simultaneously.
 	// MaximumClaims indicates the maximum number of partitions to be claimed when
 	// ClaimEntireTopic is set to false. Otherwise, it indicates the maximum number
@@ -81,6 +362,138 @@ type ConsumerOptions struct {
 	//
 	// Note this limit does not apply to claims made via FastReclaim.
 	MaximumClaims int
+
+	// MaxDeliveryAttempts is the number of times a message may be delivered before a
+	// call to Nack gives up on it. Once a message has used up its attempts, Nack sends it
+	// to the DeadLetterTopic (if set) and then commits it so the partition can advance.
+	// Set to 0 (default) to allow unlimited redeliveries.
+	MaxDeliveryAttempts int
+
+	// DeadLetterTopic is the topic that messages are produced to when they have been
+	// Nacked MaxDeliveryAttempts times. If this is empty, such messages are discarded
+	// (with a warning in the log) instead. The source topic, partition, offset and number
+	// of attempts are put in front of the message's key; see ParseDeadLetterKey.
+	DeadLetterTopic string
+
+	// NackBackoffMin and NackBackoffMax bound the delay used when Nack is called without
+	// an explicit delay. The delay starts at NackBackoffMin and doubles with every
+	// delivery attempt until it reaches NackBackoffMax, or without limit if
+	// NackBackoffMax is 0. Setting NackBackoffMin to 0 redelivers immediately.
+	NackBackoffMin time.Duration
+	NackBackoffMax time.Duration
+
+	// VisibilityTimeout is how long a delivered message may remain uncommitted before
+	// Marshal assumes whoever received it has died and redelivers it on the
+	// ConsumeChannel. This counts as a delivery attempt for MaxDeliveryAttempts, and a
+	// VisibilityTimeoutError is sent on Errors. The timer starts when the message is
+	// queued, so this should comfortably exceed the time messages spend waiting in the
+	// queue. Set to 0 (default) to disable.
+	VisibilityTimeout time.Duration
+
+	// StuckOffsetHeartbeats and StuckOffsetHandler let you find out about messages that
+	// are holding back a partition. If the same offset has been the lowest uncommitted
+	// offset of a partition for StuckOffsetHeartbeats heartbeats, StuckOffsetHandler is
+	// called (once per offset, in its own goroutine). Set StuckOffsetHeartbeats to 0
+	// (default) to disable.
+	StuckOffsetHeartbeats int
+	StuckOffsetHandler    func(OutstandingOffset)
+
+	// InitialOffset controls where we start consuming partitions that have no offset
+	// recorded for this group, either by Marshal or by Kafka. This is useful to stop
+	// new groups from replaying everything retained in a topic.
+	// Defaults to InitialOffsetEarliest.
+	InitialOffset InitialOffset
+
+	// InitialOffsetCount is the number of messages before the latest offset to start
+	// at when InitialOffset is InitialOffsetBeforeLatest.
+	InitialOffsetCount int64
+
+	// OffsetOutOfRangePolicy controls what happens when a claimed partition's offset is
+	// no longer available in Kafka. Any repositioning is heartbeated immediately and
+	// recorded in OffsetResets. Messages that were delivered before the reset can no
+	// longer be committed.
+	// Defaults to OffsetOutOfRangeRelease.
+	OffsetOutOfRangePolicy OffsetOutOfRangePolicy
+
+	// OffsetOutOfRangeHandler is called when OffsetOutOfRangePolicy is
+	// OffsetOutOfRangeCallback. It is given the offset we failed to consume and the
+	// partition's current offsets, and returns the policy to apply.
+	OffsetOutOfRangeHandler func(topicName string, partID int, offset int64,
+		offsets PartitionOffsets) OffsetOutOfRangePolicy
+
+	// OffsetStore is an optional external store for offsets. If set, it is consulted
+	// before the Marshal and Kafka offsets when a partition is claimed, which lets you
+	// record offsets transactionally alongside your output (see CommitTx). Marshal still
+	// heartbeats and commits offsets to Kafka as usual; those are used whenever the store
+	// has nothing recorded for a partition.
+	OffsetStore OffsetStore
+
+	// MaxQueueBytes overrides MarshalOptions.MaxQueueBytes for this consumer if set.
+	MaxQueueBytes int64
+
+	// RateLimit limits how fast this consumer fetches messages across all of its claims,
+	// and PartitionRateLimit how fast it fetches from each claimed partition. Use these to
+	// avoid overwhelming whatever you're sending messages to when you're far behind. Claims
+	// that are being held back by a limit aren't released for falling behind.
+	RateLimit          RateLimit
+	PartitionRateLimit RateLimit
+
+	// FlushInterval and FlushEveryNMessages make offsets durable sooner than the heartbeat
+	// interval (15-45s), so that fewer messages are replayed after a crash. Every
+	// FlushInterval, and whenever a partition has had FlushEveryNMessages commits since
+	// its last flush, we heartbeat all partitions whose offsets have advanced. Heartbeats
+	// are batched per Marshal topic partition to keep the load there down. Leave these at
+	// 0 (default) to only flush at heartbeats or when you call Flush.
+	FlushInterval       time.Duration
+	FlushEveryNMessages int
+}
+
+// OffsetStore is implemented by external systems that can record consumer offsets, such
+// as the database your consumer writes its output to. Offsets follow the same convention
+// as PartitionOffsets.Current: they are the offset of the next message to consume.
+type OffsetStore interface {
+	// Load returns the recorded offset for a partition. found must be false if nothing
+	// has been recorded for it yet.
+	Load(groupID, topicName string, partID int) (offset int64, found bool, err error)
+
+	// Save records the offset for a partition.
+	Save(groupID, topicName string, partID int, offset int64) error
+}
+
+// PartitionTimeLag estimates how far behind a claimed partition is in time, from the
+// velocities of the last ten heartbeats. See ClaimHealth.TimeLag and CatchUpTime.
+type PartitionTimeLag struct {
+	Topic  string
+	PartID int
+	Lag    int64
+
+	// Behind is how long the partition took to receive the messages we haven't consumed.
+	Behind time.Duration
+
+	// CatchUp is how long we're expected to take to reach the end of the partition. It's
+	// meaningless if CatchingUp is false, meaning we're behind and not gaining.
+	CatchUp    time.Duration
+	CatchingUp bool
+}
+
+// OutstandingOffset describes the lowest uncommitted offset of a claimed partition. Since
+// a partition's offset can only advance past messages that have been committed, this is
+// the message that is currently holding back progress.
+type OutstandingOffset struct {
+	Topic  string
+	PartID int
+	Offset int64
+
+	// Age is how long ago this offset was first delivered.
+	Age time.Duration
+
+	// Blocked is the number of offsets that have been committed but can't be recorded
+	// until this one is committed.
+	Blocked int
+
+	// Heartbeats is the number of consecutive heartbeats for which this has been the
+	// lowest uncommitted offset.
+	Heartbeats int
 }
 
 // Consumer allows you to safely consume data from a given topic in such a way that you
@@ -89,11 +502,35 @@ type ConsumerOptions struct {
 // Consumer per topic in your application!
 type Consumer struct {
 	alive    *int32
+	paused   *int32
+	limiter  *rateLimiter
 	marshal  *Marshaler
 	topics   []string
 	options  ConsumerOptions
 	messages chan *Message
 
+	// Each claim buffers its messages separately and deliveryLoop moves them into the
+	// messages channel. queueSlots and queueBytes bound the total buffered across all
+	// claims by count and size, queued is signalled when a claim buffers a message, and
+	// deliveryDone is closed when deliveryLoop exits.
+	queueSlots   chan struct{}
+	queueBytes   *queueBudget
+	queued       chan struct{}
+	deliveryDone chan struct{}
+
+	// stopChan is closed when the consumer terminates. flushRequests is signalled by claims
+	// that have reached FlushEveryNMessages commits.
+	stopChan      chan struct{}
+	flushRequests chan struct{}
+
+	// errorsLock protects the following, which back Errors, Done and Err. It's separate
+	// from lock so that claims can report errors without risking a deadlock.
+	errorsLock   *sync.Mutex
+	errorsChan   chan error
+	errorsClosed bool
+	err          error
+	done         chan struct{}
+
 	// These are used to manage topic claim notifications. These notifications are
 	// sent only when a topic claim changes state: i.e., you can assert that when
 	// receiving a notification there is some change to the global state.
@@ -101,10 +538,122 @@ type Consumer struct {
 	topicClaimsUpdated chan struct{}
 
 	// lock protects access to the following mutables.
-	lock       *sync.RWMutex
-	rand       *rand.Rand
-	partitions map[string]int
-	claims     map[string]map[int]*claim
+	lock         *sync.RWMutex
+	rand         *rand.Rand
+	partitions   map[string]int
+	claims       map[string]map[int]*claim
+	offsetResets []OffsetReset
+
+	// explainLock protects explanations, the last claim decision for each partition. It's
+	// never held while taking lock.
+	explainLock  *sync.Mutex
+	explanations map[string]map[int]ClaimExplanation
+
+	// releasesLock protects releases, the count of releases in a row of each partition
+	// for failing health checks, and releasedHealth, the last health status of claims we
+	// released recently. Claims update them, so it's never held while taking lock.
+	releasesLock   *sync.Mutex
+	releases       map[string]map[int]int
+	releasedHealth map[string]map[int]ClaimStatus
+}
+
+// queueBudget tracks the bytes of message data buffered by a consumer's claims. A limit
+// of 0 means we only keep count.
+type queueBudget struct {
+	limit int64
+
+	// lock protects the following. freed is closed (and replaced) every time bytes are
+	// released so that waiters can select on it.
+	lock  *sync.Mutex
+	used  int64
+	freed chan struct{}
+}
+
+func newQueueBudget(limit int64) *queueBudget {
+	return &queueBudget{
+		limit: limit,
+		lock:  &sync.Mutex{},
+		freed: make(chan struct{}),
+	}
+}
+
+// tryAcquire takes size bytes from the budget if they're available. If they aren't, it
+// returns a channel that is closed the next time some bytes are released. A message larger
+// than the whole budget is allowed when nothing else is queued, else it could never go.
+func (b *queueBudget) tryAcquire(size int64) (bool, <-chan struct{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.limit > 0 && b.used > 0 && b.used+size > b.limit {
+		return false, b.freed
+	}
+	b.used += size
+	return true, nil
+}
+
+// release gives size bytes back to the budget and wakes up anybody waiting for them.
+func (b *queueBudget) release(size int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.used -= size
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// Used returns how many bytes are currently taken from the budget.
+func (b *queueBudget) Used() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.used
+}
+
+// messageSize is the number of bytes a message counts for in the queue budget.
+func messageSize(msg *Message) int64 {
+	return int64(len(msg.Key) + len(msg.Value))
+}
+
+// CommitFuture is returned by CommitAsync and resolves when the committed offset has been
+// durably recorded, or it has become clear that it won't be.
+type CommitFuture struct {
+	topic  string
+	partID int
+	offset int64
+	done   chan struct{}
+	err    error
+}
+
+func newCommitFuture(topic string, partID int, offset int64) *CommitFuture {
+	return &CommitFuture{
+		topic:  topic,
+		partID: partID,
+		offset: offset,
+		done:   make(chan struct{}),
+	}
+}
+
+// resolve completes the future. It must be called exactly once.
+func (f *CommitFuture) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done returns a channel that is closed when the future has resolved.
+func (f *CommitFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns nil if the offset was recorded, or the reason it wasn't. It must only be
+// called after Done is closed.
+func (f *CommitFuture) Err() error {
+	return f.err
+}
+
+// Wait blocks until the future has resolved and returns Err.
+func (f *CommitFuture) Wait() error {
+	<-f.done
+	return f.err
 }
 
 // NewConsumer instantiates a consumer object for a given topic. You must create a
@@ -123,6 +672,18 @@ func (m *Marshaler) NewConsumer(topicNames []string, options ConsumerOptions) (*
 
 	partitions := make(map[string]int)
 
+	maxQueueBytes := m.cluster.options.MaxQueueBytes
+	if options.MaxQueueBytes > 0 {
+		maxQueueBytes = options.MaxQueueBytes
+	}
+
+	// A message waits in its claim's buffer until deliveryLoop hands it out, so we need
+	// room for at least one even if no queueing was asked for.
+	maxMessageQueue := m.cluster.options.MaxMessageQueue
+	if maxMessageQueue < 1 {
+		maxMessageQueue = 1
+	}
+
 	for _, topic := range topicNames {
 		partitions[topic] = m.Partitions(topic)
 	}
@@ -130,14 +691,30 @@ func (m *Marshaler) NewConsumer(topicNames []string, options ConsumerOptions) (*
 	// Construct base structure
 	c := &Consumer{
 		alive:              new(int32),
+		paused:             new(int32),
+		limiter:            newRateLimiter(options.RateLimit),
 		marshal:            m,
 		topics:             topicNames,
 		partitions:         partitions,
 		options:            options,
-		messages:           make(chan *Message, m.cluster.options.MaxMessageQueue),
+		messages:           make(chan *Message),
+		queueSlots:         make(chan struct{}, maxMessageQueue),
+		queueBytes:         newQueueBudget(maxQueueBytes),
+		queued:             make(chan struct{}, 1),
+		stopChan:           make(chan struct{}),
+		flushRequests:      make(chan struct{}, 1),
+		deliveryDone:       make(chan struct{}),
+		errorsLock:         &sync.Mutex{},
+		errorsChan:         make(chan error, errorsChanSize),
+		done:               make(chan struct{}),
 		lock:               &sync.RWMutex{},
 		rand:               rand.New(rand.NewSource(time.Now().UnixNano())),
 		claims:             make(map[string]map[int]*claim),
+		explainLock:        &sync.Mutex{},
+		explanations:       make(map[string]map[int]ClaimExplanation),
+		releasesLock:       &sync.Mutex{},
+		releases:           make(map[string]map[int]int),
+		releasedHealth:     make(map[string]map[int]ClaimStatus),
 		topicClaimsChan:    make(chan map[string]bool),
 		topicClaimsUpdated: make(chan struct{}, 1),
 	}
@@ -151,6 +728,10 @@ func (m *Marshaler) NewConsumer(topicNames []string, options ConsumerOptions) (*
 	// Start notifier about topic claims now because people are going to start
 	// listening immediately
 	go c.sendTopicClaimsLoop()
+	go c.deliveryLoop()
+	if c.options.FlushInterval > 0 || c.options.FlushEveryNMessages > 0 {
+		go c.flushLoop()
+	}
 
 	// Fast-reclaim: iterate over existing claims in the given topics and see if
 	// any of them look to be from previous incarnations of this Marshal (client, group)
@@ -172,7 +753,8 @@ func (m *Marshaler) NewConsumer(topicNames []string, options ConsumerOptions) (*
 				// This looks to be ours, let's do it. This is basically the fast path,
 				// and our heartbeat will happen shortly from the automatic health
 				// check which fires up immediately on newClaim.
-				log.Infof("[%s:%d] attempting to fast-reclaim", topic, partID)
+				log.Info("attempting to fast-reclaim",
+					partitionFields(c.marshal, topic, partID)...)
 				if _, ok := c.claims[topic]; !ok {
 					c.claims[topic] = make(map[int]*claim)
 				}
@@ -185,17 +767,18 @@ func (m *Marshaler) NewConsumer(topicNames []string, options ConsumerOptions) (*
 
 					// don't fast re-claim partitions for a topic unless partition 0 is claimed
 					if !claimedTopics[topic] {
-						log.Infof("[%s:%d] blocked fast-reclaim because topic is not claimed",
-							topic, partID)
+						log.Info("blocked fast-reclaim because topic is not claimed",
+							partitionFields(c.marshal, topic, partID)...)
 						continue
 					}
 				}
 
 				// Attempt to claim, this can fail
 				claim := newClaim(
-					topic, partID, c.marshal, c, c.messages, options)
+					topic, partID, c.marshal, c, c.newClaimBuffer(), options)
 				if claim == nil {
-					log.Warningf("[%s:%d] failed to fast-reclaim", topic, partID)
+					log.Warn("failed to fast-reclaim",
+						partitionFields(c.marshal, topic, partID)...)
 				} else {
 					c.claims[topic][partID] = claim
 					go claim.healthCheckLoop()
@@ -205,8 +788,8 @@ func (m *Marshaler) NewConsumer(topicNames []string, options ConsumerOptions) (*
 
 			// this check needs to be after iterating all partitions in a topic
 			if options.ClaimEntireTopic && len(claimedTopics) >= options.MaximumClaims {
-				log.Infof("reached max-topics for fast-reclaim. Claimed topics: %v",
-					claimedTopics)
+				log.Info("reached max-topics for fast-reclaim",
+					c.logFields("claimed_topics", claimedTopics)...)
 				break
 			}
 		}
@@ -223,6 +806,8 @@ func NewConsumerOptions() ConsumerOptions {
 		ClaimEntireTopic:      false,
 		GreedyClaims:          false,
 		ReleaseClaimsIfBehind: true,
+		NackBackoffMin:        1 * time.Second,
+		NackBackoffMax:        1 * time.Minute,
 	}
 }
 
@@ -231,7 +816,7 @@ func (c *Consumer) defaultTopic() string {
 	defer c.lock.RUnlock()
 
 	if len(c.partitions) > 1 {
-		log.Errorf("attempted to claim partitions for more than one topic")
+		log.Error("attempted to claim partitions for more than one topic", c.logFields()...)
 		go c.Terminate(false)
 		return ""
 	}
@@ -240,7 +825,7 @@ func (c *Consumer) defaultTopic() string {
 		return topic
 	}
 
-	log.Errorf("couldn't find default topic!")
+	log.Error("couldn't find default topic", c.logFields()...)
 	go c.Terminate(false)
 	return ""
 }
@@ -250,7 +835,7 @@ func (c *Consumer) defaultTopicPartitions() int {
 	defer c.lock.RUnlock()
 
 	if len(c.partitions) > 1 {
-		log.Errorf("attempted to claim partitions for more than one topic")
+		log.Error("attempted to claim partitions for more than one topic", c.logFields()...)
 		go c.Terminate(false)
 		return 0
 	}
@@ -259,7 +844,7 @@ func (c *Consumer) defaultTopicPartitions() int {
 		return partitions
 	}
 
-	log.Errorf("couldn't find default topic!")
+	log.Error("couldn't find default topic", c.logFields()...)
 	go c.Terminate(false)
 	return 0
 }
@@ -298,10 +883,14 @@ func (c *Consumer) claimTerminated(cl *claim, released bool) {
 func (c *Consumer) tryClaimPartition(topic string, partID int) bool {
 	if c.options.ClaimEntireTopic {
 		if c.isTopicClaimLimitReached(topic) {
+			c.explain(topic, partID, DecisionClaimLimitReached, fmt.Sprintf(
+				"already claimed the maximum of %d topics", c.options.MaximumClaims))
 			return false
 		}
 	} else {
 		if c.isClaimLimitReached() {
+			c.explain(topic, partID, DecisionClaimLimitReached, fmt.Sprintf(
+				"already claimed the maximum of %d partitions", c.options.MaximumClaims))
 			return false
 		}
 	}
@@ -311,14 +900,21 @@ func (c *Consumer) tryClaimPartition(topic string, partID int) bool {
 	// This gives us no protection.
 	currentClaim := c.marshal.GetPartitionClaim(topic, partID)
 	if currentClaim.Claimed() {
+		c.explainClaimed(topic, partID, currentClaim)
 		return false
 	}
 
 	// Attempt to claim. This handles asynchronously and might ultimately fail because
 	// someone beat us to the claim or we failed to produce to Kafka or something. This can
 	// block for a while.
-	newClaim := newClaim(topic, partID, c.marshal, c, c.messages, c.options)
+	newClaim := newClaim(topic, partID, c.marshal, c, c.newClaimBuffer(), c.options)
 	if newClaim == nil {
+		if pc := c.marshal.GetPartitionClaim(topic, partID); pc.Claimed() {
+			c.explainClaimed(topic, partID, pc)
+		} else {
+			c.explain(topic, partID, DecisionClaimFailed,
+				"failed to fetch offsets or produce the claim")
+		}
 		return false
 	}
 	go newClaim.healthCheckLoop()
@@ -353,9 +949,11 @@ func (c *Consumer) tryClaimPartition(topic string, partID int) bool {
 		oldClaim, ok := topicClaims[partID]
 		if ok && oldClaim != nil {
 			if !oldClaim.Terminated() {
-				log.Errorf("Internal double-claim for %s:%d.", topic, partID)
-				log.Errorf("This is a catastrophic error. We're terminating Marshal.")
-				log.Errorf("No further messages will be available. Please restart.")
+				log.Error("internal double-claim, this is a catastrophic error and we're "+
+					"terminating Marshal; no further messages will be available, please restart",
+					partitionFields(c.marshal, topic, partID)...)
+				c.fail(&FencedError{Topic: topic, Partition: partID,
+					Reason: "internal double-claim"})
 				go newClaim.Release()
 				go c.terminateAndCleanup(false, false)
 				go func() {
@@ -373,6 +971,7 @@ func (c *Consumer) tryClaimPartition(topic string, partID int) bool {
 
 	// Save the claim, this makes it available for message consumption and status.
 	c.claims[topic][partID] = newClaim
+	c.explain(topic, partID, DecisionClaimed, "")
 	return true
 }
 
@@ -393,8 +992,8 @@ func (c *Consumer) releaseClaims() {
 	for topic, partitions := range c.claims {
 		for partID, claim := range partitions {
 			if !claim.Terminated() {
-				log.Warningf("[%s:%d] Consumer still paused, releasing claim",
-					topic, partID)
+				log.Warn("consumer still paused, releasing claim",
+					partitionFields(c.marshal, topic, partID)...)
 				claim.Release()
 			}
 		}
@@ -410,7 +1009,8 @@ func (c *Consumer) claimPartitions() {
 		c.lock.RLock()
 		defer c.lock.RUnlock()
 		if len(c.partitions) > 1 {
-			log.Errorf("attempted to claim partitions for more than a single topic")
+			log.Error("attempted to claim partitions for more than a single topic",
+				c.logFields()...)
 			go c.Terminate(false)
 		}
 	}()
@@ -425,6 +1025,9 @@ func (c *Consumer) claimPartitions() {
 	// This is just an optimization, because we aren't holding the lock here
 	// this check is repeated inside tryClaimPartition.
 	if c.isClaimLimitReached() {
+		c.explainTopic(topic, partitions, DecisionClaimLimitReached, fmt.Sprintf(
+			"already claimed the maximum of %d partitions", c.options.MaximumClaims),
+			PartitionClaim{})
 		return
 	}
 
@@ -435,6 +1038,7 @@ func (c *Consumer) claimPartitions() {
 		// Get the most recent claim for this partition
 		lastClaim := c.marshal.GetLastPartitionClaim(topic, partID)
 		if lastClaim.Claimed() {
+			c.explainClaimed(topic, partID, lastClaim)
 			continue
 		}
 
@@ -443,14 +1047,19 @@ func (c *Consumer) claimPartitions() {
 		// claiming this partition.
 		if lastClaim.GroupID == c.marshal.groupID &&
 			lastClaim.ClientID == c.marshal.clientID {
-			// Check release time, if it's over a heartbeat interval allow us to reclaim it
-			if time.Now().Unix()-lastClaim.LastRelease < HeartbeatInterval {
-				log.Infof("[%s:%d] skipping unclaimed partition because we recently released it",
-					topic, partID)
+			// Check release time, the ReclaimPolicy decides when we may reclaim it
+			since := time.Duration(time.Now().Unix()-lastClaim.LastRelease) * time.Second
+			delay := c.reclaimDelay(topic, partID, lastClaim.LastRelease)
+			if since < delay {
+				log.Info("skipping unclaimed partition because we recently released it",
+					partitionFields(c.marshal, topic, partID, "released_ago", since,
+						"reclaim_delay", delay)...)
+				c.explain(topic, partID, DecisionRecentlyReleased, fmt.Sprintf(
+					"released by us %s ago, waiting %s to reclaim", since, delay))
 				continue
 			} else {
-				log.Infof("[%s:%d] reclaiming because we released it a while ago",
-					topic, partID)
+				log.Info("reclaiming because we released it a while ago",
+					partitionFields(c.marshal, topic, partID)...)
 			}
 		}
 
@@ -522,26 +1131,34 @@ func (c *Consumer) claimTopics() {
 			if lastClaim.GroupID != c.marshal.groupID ||
 				lastClaim.ClientID != c.marshal.clientID {
 				// in case we had this topic, but now somebody else has claimed it
+				c.explainTopic(topic, partitions, DecisionTopicOwnedByOther,
+					fmt.Sprintf("topic claimed by %s/%s", lastClaim.GroupID,
+						lastClaim.ClientID), lastClaim)
 				continue
 			}
 		} else {
 			// Unclaimed, so attempt to claim partition 0. This is how we key topic claims.
-			log.Infof("[%s] attempting to claim topic (key partition 0)", topic)
+			log.Info("attempting to claim topic (key partition 0)",
+				c.logFields("topic", topic)...)
 
 			// we need to check if we're above the maximum topics to be claimed
 			// we should only allow the first k topics to be claimed and allow all
 			// of their partitions to be claimed. This is controlled by controlling how
 			// many (key partition 0) we claim.
 			if c.isTopicClaimLimitReached(topic) {
-				log.Debugf("[%s] blocked claiming topic due to limit: %d",
-					topic, c.options.MaximumClaims)
+				log.Debug("blocked claiming topic due to limit",
+					c.logFields("topic", topic, "limit", c.options.MaximumClaims)...)
+				c.explainTopic(topic, partitions, DecisionClaimLimitReached, fmt.Sprintf(
+					"already claimed the maximum of %d topics", c.options.MaximumClaims),
+					PartitionClaim{})
 				continue
 			}
 
 			if !c.tryClaimPartition(topic, 0) {
 				continue
 			}
-			log.Infof("[%s] claimed topic (key partition 0) successfully", topic)
+			log.Info("claimed topic (key partition 0) successfully",
+				c.logFields("topic", topic)...)
 
 			// Optimistically send update to try to reduce latency between us claiming a
 			// topic and notifying a listener
@@ -551,10 +1168,13 @@ func (c *Consumer) claimTopics() {
 		// We either just claimed or we have already owned the 0th partition. Let's iterate
 		// through all partitions and attempt to claim any that we don't own yet.
 		for partID := 1; partID < partitions; partID++ {
-			if !c.marshal.Claimed(topic, partID) {
-				log.Infof("[%s:%d] claiming partition (topic claim mode)", topic, partID)
-				c.tryClaimPartition(topic, partID)
+			if pc := c.marshal.GetPartitionClaim(topic, partID); pc.LastHeartbeat > 0 {
+				c.explainClaimed(topic, partID, pc)
+				continue
 			}
+			log.Info("claiming partition (topic claim mode)",
+				partitionFields(c.marshal, topic, partID)...)
+			c.tryClaimPartition(topic, partID)
 		}
 	}
 }
@@ -584,7 +1204,7 @@ func (c *Consumer) sendTopicClaimsLoop() {
 		// Get consistent claims and send them
 		claims, err := c.GetCurrentTopicClaims()
 		if err != nil {
-			log.Errorf("Failed to send topic claims update: %s", err)
+			log.Error("failed to send topic claims update", c.logFields("err", err)...)
 			continue
 		}
 
@@ -650,9 +1270,13 @@ func (c *Consumer) manageClaims() {
 	for !c.Terminated() {
 		c.updatePartitionCounts()
 
-		// If we learn that our consumer group is paused, release all claims.
+		// If we learn that our consumer group is paused, release all claims. If we've
+		// been paused locally we keep what we have but don't claim anything new.
 		if c.marshal.cluster.IsGroupPaused(c.marshal.GroupID()) {
 			c.releaseClaims()
+			c.explainAll(DecisionGroupPaused, "consumer group is paused")
+		} else if c.Paused() {
+			c.explainAll(DecisionConsumerPaused, "consumer is paused")
 		} else {
 			// Attempt to claim more partitions, this always runs and will keep running until all
 			// partitions in the topic are claimed (by somebody).
@@ -669,6 +1293,92 @@ func (c *Consumer) manageClaims() {
 	}
 }
 
+// Pause stops this consumer from fetching messages for all of its claims, without giving
+// any of them up. We keep heartbeating, the health checks won't release claims for being
+// behind while paused, and no new partitions are claimed. Use this if whatever you're
+// sending messages to is unavailable.
+func (c *Consumer) Pause() {
+	if atomic.CompareAndSwapInt32(c.paused, 0, 1) {
+		log.Info("consumer pausing consumption", c.logFields("topics", c.topics)...)
+	}
+}
+
+// Resume undoes Pause. Partitions that were paused individually stay paused.
+func (c *Consumer) Resume() {
+	if !atomic.CompareAndSwapInt32(c.paused, 1, 0) {
+		return
+	}
+	log.Info("consumer resuming consumption", c.logFields("topics", c.topics)...)
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, topicClaims := range c.claims {
+		for _, cl := range topicClaims {
+			if !cl.Paused() {
+				cl.resetHealth()
+			}
+		}
+	}
+}
+
+// Paused returns whether this consumer has been paused with Pause.
+func (c *Consumer) Paused() bool {
+	return atomic.LoadInt32(c.paused) == 1
+}
+
+// PausePartition is like Pause, but only for a single partition this consumer has claimed.
+func (c *Consumer) PausePartition(topicName string, partID int) error {
+	cl, err := c.getActiveClaim(topicName, partID)
+	if err != nil {
+		return err
+	}
+	cl.Pause()
+	return nil
+}
+
+// ResumePartition undoes PausePartition. It has no effect if the whole consumer is paused.
+func (c *Consumer) ResumePartition(topicName string, partID int) error {
+	cl, err := c.getActiveClaim(topicName, partID)
+	if err != nil {
+		return err
+	}
+	cl.Resume()
+	return nil
+}
+
+// ReleasePartition gives up our claim on a partition after committing what we can. The
+// partition is then available to be claimed again, possibly by this consumer.
+func (c *Consumer) ReleasePartition(topicName string, partID int) error {
+	cl, err := c.getActiveClaim(topicName, partID)
+	if err != nil {
+		return err
+	}
+	if !cl.Release() {
+		return fmt.Errorf("Partition %s:%d is already being released.", topicName, partID)
+	}
+	return nil
+}
+
+// logFields returns the fields identifying this consumer in log messages, followed by keyvals.
+func (c *Consumer) logFields(keyvals ...interface{}) []interface{} {
+	return append([]interface{}{"group", c.marshal.groupID, "client", c.marshal.clientID},
+		keyvals...)
+}
+
+// getActiveClaim returns our claim on a partition, or an error if we don't hold it.
+func (c *Consumer) getActiveClaim(topicName string, partID int) (*claim, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	cl, ok := c.claims[topicName][partID]
+	if !ok || cl.Terminated() {
+		return nil, fmt.Errorf("Partition %s:%d is not claimed by this consumer.",
+			topicName, partID)
+	}
+	return cl, nil
+}
+
 // Terminated returns whether or not this consumer has been terminated.
 func (c *Consumer) Terminated() bool {
 	return atomic.LoadInt32(c.alive) == 0
@@ -685,6 +1395,11 @@ func (c *Consumer) terminateAndCleanup(release bool, remove bool) bool {
 	latestTopicClaims := make(map[string]bool)
 	releasedTopics := make(map[string]bool)
 
+	// Stop delivering before taking the lock, since deliveryLoop needs it to find claims.
+	// Messages still buffered by the claims are dropped with them below.
+	close(c.stopChan)
+	<-c.deliveryDone
+
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -720,9 +1435,91 @@ func (c *Consumer) terminateAndCleanup(release bool, remove bool) bool {
 	// Update the claims one last time
 	c.sendTopicClaimsUpdate()
 	close(c.topicClaimsUpdated)
+	c.finish()
 	return true
 }
 
+// Errors returns a channel of errors that happen in the background, such as losing a
+// claim. The consumer carries on after most of these; if it has to stop, the error is
+// sent here and also returned by Err. The channel is closed when the consumer terminates.
+// If you don't read from it, errors are dropped once it's full.
+func (c *Consumer) Errors() <-chan error {
+	return c.errorsChan
+}
+
+// Done returns a channel that is closed when the consumer has terminated, for whatever
+// reason.
+func (c *Consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns nil while the consumer is running. Once Done is closed it returns why the
+// consumer stopped: ErrConsumerTerminated if Terminate was called (directly or through
+// the Marshaler), else a *FencedError or *ClusterTerminatedError.
+func (c *Consumer) Err() error {
+	select {
+	case <-c.done:
+	default:
+		return nil
+	}
+
+	c.errorsLock.Lock()
+	defer c.errorsLock.Unlock()
+
+	return c.err
+}
+
+// reportError sends an error to the Errors channel without blocking.
+func (c *Consumer) reportError(err error) {
+	c.errorsLock.Lock()
+	defer c.errorsLock.Unlock()
+
+	c.sendError(err)
+}
+
+// sendError is reportError for when errorsLock is already held.
+func (c *Consumer) sendError(err error) {
+	if c.errorsClosed {
+		return
+	}
+	select {
+	case c.errorsChan <- err:
+	default:
+		log.Warn("consumer errors channel full, dropping error", c.logFields("err", err)...)
+	}
+}
+
+// fail records the error that is causing the consumer to stop and reports it. The caller
+// is responsible for terminating the consumer.
+func (c *Consumer) fail(err error) {
+	c.errorsLock.Lock()
+	defer c.errorsLock.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	c.sendError(err)
+}
+
+// finish is called at the end of termination to record why we stopped, if nobody has yet,
+// and close the Errors and Done channels.
+func (c *Consumer) finish() {
+	c.errorsLock.Lock()
+	defer c.errorsLock.Unlock()
+
+	if c.err == nil {
+		if err := c.marshal.cluster.terminationError(); err != nil {
+			c.err = &ClusterTerminatedError{Err: err}
+			c.sendError(c.err)
+		} else {
+			c.err = ErrConsumerTerminated
+		}
+	}
+	c.errorsClosed = true
+	close(c.errorsChan)
+	close(c.done)
+}
+
 // Terminate instructs the consumer to clean up and allow other consumers to begin consuming.
 // (If you do not call this method before exiting, things will still work, but more slowly.)
 func (c *Consumer) Terminate(release bool) bool {
@@ -762,9 +1559,8 @@ func (c *Consumer) GetCurrentTopicClaims() (map[string]bool, error) {
 // It's only relevant when CLaimEntireTopic is set
 func (c *Consumer) TopicClaims() <-chan map[string]bool {
 	if !c.options.ClaimEntireTopic {
-		err := fmt.Errorf(
-			"GetCurrentTopicClaims is only relevant when ClaimEntireTopic is set")
-		log.Error(err.Error())
+		log.Error("TopicClaims is only relevant when ClaimEntireTopic is set",
+			c.logFields()...)
 	}
 
 	return c.topicClaimsChan
@@ -790,6 +1586,83 @@ func (c *Consumer) GetCurrentLag() int64 {
 	return lag
 }
 
+// GetCurrentTimeLag returns how far behind this consumer is in time: the largest
+// PartitionTimeLag.Behind of its claims. Unlike GetCurrentLag this can be compared across
+// topics that are produced to at different rates.
+func (c *Consumer) GetCurrentTimeLag() time.Duration {
+	var lag time.Duration
+	for _, tl := range c.GetPartitionTimeLags() {
+		if tl.Behind > lag {
+			lag = tl.Behind
+		}
+	}
+	return lag
+}
+
+// GetPartitionTimeLags returns time lag estimates for each partition this consumer has
+// claimed, ordered by topic and partition.
+func (c *Consumer) GetPartitionTimeLags() []PartitionTimeLag {
+	var lags []PartitionTimeLag
+	for _, cl := range c.claimList() {
+		if !cl.Terminated() {
+			lags = append(lags, cl.timeLag())
+		}
+	}
+	sort.Slice(lags, func(i, j int) bool {
+		if lags[i].Topic != lags[j].Topic {
+			return lags[i].Topic < lags[j].Topic
+		}
+		return lags[i].PartID < lags[j].PartID
+	})
+	return lags
+}
+
+// OutstandingOffsets returns the lowest uncommitted offset for each partition this consumer
+// has claimed. Partitions where every delivered message has been committed are omitted.
+// This is useful for finding messages that your application has lost track of or is
+// unable to process.
+func (c *Consumer) OutstandingOffsets() []OutstandingOffset {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var out []OutstandingOffset
+	for _, topicClaims := range c.claims {
+		for _, cl := range topicClaims {
+			if cl.Terminated() {
+				continue
+			}
+			if oo, ok := cl.OutstandingOffset(); ok {
+				out = append(out, oo)
+			}
+		}
+	}
+	return out
+}
+
+// recordOffsetReset is called by a claim that has been moved to a new offset.
+func (c *Consumer) recordOffsetReset(reset OffsetReset) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.offsetResets = append(c.offsetResets, reset)
+	if len(c.offsetResets) > maxOffsetResets {
+		c.offsetResets = c.offsetResets[len(c.offsetResets)-maxOffsetResets:]
+	}
+}
+
+// OffsetResets returns the most recent times that one of our claims had to be moved
+// because its offset was out of range, oldest first. Use this to audit for data loss.
+// Only the last maxOffsetResets are kept, and only in memory; the last skipped range of
+// each partition is also recorded in the Marshal topic, see PartitionClaim.SkippedFrom.
+func (c *Consumer) OffsetResets() []OffsetReset {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	resets := make([]OffsetReset, len(c.offsetResets))
+	copy(resets, c.offsetResets)
+	return resets
+}
+
 // GetCurrentLoad returns a number representing the "load" of this consumer. Think of this
 // like a load average in Unix systems: the numbers are kind of related to how much work
 // the system is doing, but by itself they don't tell you much.
@@ -797,6 +1670,66 @@ func (c *Consumer) GetCurrentLoad() int {
 	return c.getNumActiveClaims()
 }
 
+// Health returns the outcome of the last health check of each of our active claims, and
+// of claims that were released by a health check in the last releasedHealthTTL (with
+// Released set). The overall status is StatusUnhealthy once the consumer has terminated,
+// StatusGroupPaused while our group is paused by an Admin, or StatusDegraded if any claim
+// is too slow, stalled or has an expired heartbeat. It's meant to back readiness probes
+// and alerting.
+func (c *Consumer) Health() ConsumerHealth {
+	health := ConsumerHealth{Status: StatusHealthy, Claims: make([]ClaimStatus, 0)}
+	active := make(map[string]map[int]bool)
+	for _, cl := range c.claimList() {
+		if cl.Terminated() {
+			continue
+		}
+		health.Claims = append(health.Claims, cl.healthStatus())
+		if active[cl.topic] == nil {
+			active[cl.topic] = make(map[int]bool)
+		}
+		active[cl.topic][cl.partID] = true
+	}
+	for _, status := range c.recentlyReleased() {
+		if !active[status.Topic][status.Partition] {
+			health.Claims = append(health.Claims, status)
+		}
+	}
+	sort.Slice(health.Claims, func(i, j int) bool {
+		a, b := health.Claims[i], health.Claims[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Partition < b.Partition
+	})
+
+	if c.Terminated() {
+		health.Status = StatusUnhealthy
+		health.Reason = "consumer terminated"
+		if err := c.Err(); err != nil {
+			health.Reason = err.Error()
+		}
+		return health
+	}
+
+	if c.marshal.cluster.IsGroupPaused(c.marshal.GroupID()) {
+		health.Status = StatusGroupPaused
+		health.Reason = "consumer group is paused"
+		return health
+	}
+
+	degraded := 0
+	for _, status := range health.Claims {
+		if status.degraded() {
+			degraded++
+		}
+	}
+	if degraded > 0 {
+		health.Status = StatusDegraded
+		health.Reason = fmt.Sprintf("%d of %d claims unhealthy", degraded, len(health.Claims))
+	}
+	return health
+}
+
 // getNumActiveClaims returns the number of claims actively owned by this Consumer.
 func (c *Consumer) getNumActiveClaims() (ct int) {
 	c.lock.RLock()
@@ -820,11 +1753,90 @@ func (c *Consumer) isClaimLimitReached() bool {
 }
 
 // ConsumeChannel returns a read-only channel. Messages that are retrieved from Kafka will be
-// made available in this channel.
+// made available in this channel. Messages are taken from each claimed partition in turn,
+// so a partition with a large backlog doesn't hold up the others.
 func (c *Consumer) ConsumeChannel() <-chan *Message {
 	return c.messages
 }
 
+// newClaimBuffer returns the channel a new claim buffers its messages in. It's as large as
+// the whole queue so that a single claim can use all of it if nobody else needs it.
+func (c *Consumer) newClaimBuffer() chan *Message {
+	return make(chan *Message, cap(c.queueSlots))
+}
+
+// notifyQueued is called by claims when they've buffered a message, to wake deliveryLoop
+// if it's waiting. This never blocks.
+func (c *Consumer) notifyQueued() {
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+}
+
+// deliveryLoop moves messages from the claims' buffers to the messages channel. Each pass
+// takes at most one message from every claim, which keeps low volume partitions from being
+// starved by busy ones (and then released for being slow).
+func (c *Consumer) deliveryLoop() {
+	defer close(c.deliveryDone)
+
+	for {
+		delivered := false
+		for _, cl := range c.claimList() {
+			select {
+			case msg := <-cl.messages:
+				if !c.deliver(cl, msg) {
+					return
+				}
+				delivered = true
+			default:
+			}
+		}
+
+		// If nothing was buffered, wait until a claim tells us otherwise
+		if !delivered {
+			select {
+			case <-c.queued:
+			case <-c.stopChan:
+				return
+			}
+		}
+	}
+}
+
+// claimList returns all of our claims.
+func (c *Consumer) claimList() []*claim {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var claims []*claim
+	for _, topicClaims := range c.claims {
+		for _, cl := range topicClaims {
+			claims = append(claims, cl)
+		}
+	}
+	return claims
+}
+
+// deliver hands a message taken from a claim's buffer to the client and frees its queue
+// slot. Returns false if the consumer is shutting down.
+func (c *Consumer) deliver(cl *claim, msg *Message) bool {
+	defer cl.unreserve(msg)
+
+	// Messages from claims we've lost can't be committed, don't bother handing them out
+	if cl.Terminated() {
+		return true
+	}
+
+	select {
+	case c.messages <- msg:
+		cl.markDelivered(msg)
+		return true
+	case <-c.stopChan:
+		return false
+	}
+}
+
 // consumeOne returns a single message. This is mostly used within the test suite to
 // make testing easier as it simulates the message handling behavior.
 func (c *Consumer) consumeOne() *Message {
@@ -849,7 +1861,157 @@ func (c *Consumer) Commit(msg *Message) error {
 		return fmt.Errorf("Message not committed (claim for topic %s, partition %d expired).",
 			msg.Topic, msg.Partition)
 	}
-	return cl.Commit(msg.Offset)
+	return cl.commitMessage(msg)
+}
+
+// CommitAsync is like Commit, but also returns a CommitFuture that resolves once the
+// message's offset has been durably recorded, i.e. a heartbeat covering it has been written
+// to the Marshal topic and the offset committed to Kafka. That happens at the next
+// heartbeat or Flush of the partition after every earlier message has been committed too.
+// If the claim ends or is moved with Seek first, the future resolves with an error.
+func (c *Consumer) CommitAsync(msg *Message) *CommitFuture {
+	cl, ok := func() (*claim, bool) {
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+
+		cl, ok := c.claims[msg.Topic][int(msg.Partition)]
+		return cl, ok
+	}()
+	if !ok {
+		future := newCommitFuture(msg.Topic, int(msg.Partition), msg.Offset)
+		future.resolve(fmt.Errorf("Message not committed (claim for topic %s, partition %d expired).",
+			msg.Topic, msg.Partition))
+		return future
+	}
+	return cl.commitAsync(msg)
+}
+
+// CommitTx commits a message and records the resulting partition offset in an external
+// store. The hook is called with the offset that is now safe to record for the message's
+// partition, i.e. the offset of the oldest message that has not yet been committed; it
+// should write that offset in the same transaction as the output of processing the message.
+// The message is only marked committed if the hook returns nil. If hook is nil, the offset
+// is written with the Save method of the consumer's OffsetStore instead.
+//
+// Calls to CommitTx are serialized per partition so that recorded offsets never go
+// backwards. For effectively-once delivery you should process each partition in order.
+func (c *Consumer) CommitTx(msg *Message, hook func(offset int64) error) error {
+	cl, ok := func() (*claim, bool) {
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+
+		cl, ok := c.claims[msg.Topic][int(msg.Partition)]
+		return cl, ok
+	}()
+	if !ok {
+		return fmt.Errorf("Message not committed (claim for topic %s, partition %d expired).",
+			msg.Topic, msg.Partition)
+	}
+
+	if hook == nil {
+		if c.options.OffsetStore == nil {
+			return errors.New("CommitTx requires a hook or options.OffsetStore be set")
+		}
+		hook = func(offset int64) error {
+			return c.options.OffsetStore.Save(
+				c.marshal.GroupID(), msg.Topic, int(msg.Partition), offset)
+		}
+	}
+	return cl.CommitTx(msg, hook)
+}
+
+// Nack is called when you were unable to process a message and want it delivered again.
+// The message will be redelivered on the ConsumeChannel after the given delay; a delay of
+// 0 uses an exponential backoff based on how many times the message has been delivered
+// (see NackBackoffMin). If the message has already been delivered MaxDeliveryAttempts
+// times, it is instead produced to the DeadLetterTopic and committed.
+//
+// The message stays outstanding until it is finally committed, so the offsets of this
+// partition will not advance past it in the meantime. Nacking a message again before it
+// has been redelivered is an error.
+func (c *Consumer) Nack(msg *Message, delay time.Duration) error {
+	cl, ok := func() (*claim, bool) {
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+
+		cl, ok := c.claims[msg.Topic][int(msg.Partition)]
+		return cl, ok
+	}()
+	if !ok {
+		return fmt.Errorf("Message not nacked (claim for topic %s, partition %d expired).",
+			msg.Topic, msg.Partition)
+	}
+	return cl.Nack(msg, delay)
+}
+
+// Seek moves a partition that this consumer has claimed to the given offset. Any messages
+// from the partition that have not been committed are forgotten about, the Kafka consumer
+// restarts at the new offset, and the new position is heartbeated immediately, so this
+// can be used to rewind or skip ahead in one partition without disturbing the others.
+//
+// Messages from the partition that were queued but not yet received are dropped. A message
+// that was already on its way to you may still arrive, but it can no longer be committed
+// or nacked.
+func (c *Consumer) Seek(topicName string, partID int, offset int64) error {
+	cl, err := c.getActiveClaim(topicName, partID)
+	if err != nil {
+		return err
+	}
+	return cl.SeekTo(offset)
+}
+
+// flushLoop periodically flushes the offsets of claims that have advanced. See
+// ConsumerOptions.FlushInterval and FlushEveryNMessages.
+func (c *Consumer) flushLoop() {
+	var tick <-chan time.Time
+	if c.options.FlushInterval > 0 {
+		ticker := time.NewTicker(c.options.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+		case <-c.flushRequests:
+		case <-c.stopChan:
+			return
+		}
+		c.flushAdvanced()
+	}
+}
+
+// requestFlush asks flushLoop to flush soon. This never blocks.
+func (c *Consumer) requestFlush() {
+	select {
+	case c.flushRequests <- struct{}{}:
+	default:
+	}
+}
+
+// flushAdvanced heartbeats every claim whose offset has advanced since it was last recorded,
+// in as few produces as possible.
+func (c *Consumer) flushAdvanced() {
+	var flushing []*claim
+	var beats []partitionOffset
+	for _, cl := range c.claimList() {
+		if cl.Terminated() {
+			continue
+		}
+		if didAdvance, offset := cl.updateCurrentOffsets(); didAdvance {
+			flushing = append(flushing, cl)
+			beats = append(beats, partitionOffset{cl.topic, cl.partID, offset})
+		}
+	}
+	if len(beats) == 0 {
+		return
+	}
+
+	for i, result := range c.marshal.heartbeats(beats) {
+		if err := flushing[i].flushed(beats[i].offset, result); err != nil {
+			log.Error("flush error", c.logFields("err", err)...)
+		}
+	}
 }
 
 // Flush will cause us to upate all of the committed offsets. This operation can be
@@ -889,7 +2051,7 @@ func (c *Consumer) Flush() error {
 	anyErrors := false
 	for err := range errChan {
 		anyErrors = true
-		log.Errorf("Flush error: %s", err)
+		log.Error("flush error", c.logFields("err", err)...)
 	}
 	if anyErrors {
 		return errors.New("One or more errors encountered flushing offsets.")
@@ -900,7 +2062,8 @@ func (c *Consumer) Flush() error {
 // CommitByToken is called when you've finished processing a message. In the at-least-once
 // consumption case, this will allow the "last processed offset" to move forward so that
 // we can never see this message again. This particular method is used when you've only
-// got a CommitToken to commit from.
+// got a CommitToken to commit from. Tokens from an earlier claim of the partition, or from
+// before a Seek, are rejected.
 func (c *Consumer) CommitByToken(token CommitToken) error {
 	cl, ok := func() (*claim, bool) {
 		c.lock.RLock()
@@ -913,19 +2076,37 @@ func (c *Consumer) CommitByToken(token CommitToken) error {
 		return fmt.Errorf("Message not committed (claim for topic %s, partition %d expired).",
 			token.topic, token.partID)
 	}
-	return cl.Commit(token.offset)
+	return cl.commitToken(token)
 }
 
-// PrintState outputs the status of the consumer.
-func (c *Consumer) PrintState() {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+// ConsumerStats is a point in time summary of a consumer's resource usage.
+type ConsumerStats struct {
+	// QueuedMessages and QueuedBytes are the number and total size of messages that have
+	// been fetched from Kafka but not yet received from the ConsumeChannel.
+	QueuedMessages int
+	QueuedBytes    int64
 
-	log.Infof("  CONSUMER: %d messages in queue", len(c.messages))
-	for _, topic := range c.topics {
-		log.Infof("    TOPIC: %s", topic)
-		for _, claim := range c.claims[topic] {
-			claim.PrintState()
-		}
+	// MaxQueuedMessages and MaxQueuedBytes are the limits on the above. MaxQueuedBytes is
+	// 0 if there is no limit.
+	MaxQueuedMessages int
+	MaxQueuedBytes    int64
+
+	// TimeLag is how far behind the consumer is in time, see GetCurrentTimeLag.
+	TimeLag time.Duration
+}
+
+// Stats returns the current ConsumerStats for this consumer.
+func (c *Consumer) Stats() ConsumerStats {
+	return ConsumerStats{
+		QueuedMessages:    len(c.queueSlots),
+		QueuedBytes:       c.queueBytes.Used(),
+		MaxQueuedMessages: cap(c.queueSlots),
+		MaxQueuedBytes:    c.queueBytes.limit,
+		TimeLag:           c.GetCurrentTimeLag(),
 	}
 }
+
+// PrintState outputs the status of the consumer.
+func (c *Consumer) PrintState() {
+	c.Snapshot().printState()
+}
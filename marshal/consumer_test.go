@@ -1,6 +1,8 @@
 package marshal
 
 import (
+	"encoding/json"
+	"errors"
 	"math/rand"
 	"sort"
 	"strconv"
@@ -29,6 +31,7 @@ type ConsumerSuite struct {
 func NewTestConsumer(m *Marshaler, topics []string) *Consumer {
 	cn := &Consumer{
 		alive:              new(int32),
+		paused:             new(int32),
 		marshal:            m,
 		topics:             topics,
 		options:            NewConsumerOptions(),
@@ -36,7 +39,21 @@ func NewTestConsumer(m *Marshaler, topics []string) *Consumer {
 		lock:               &sync.RWMutex{},
 		rand:               rand.New(rand.NewSource(time.Now().UnixNano())),
 		claims:             make(map[string]map[int]*claim),
-		messages:           make(chan *Message, 1000),
+		explainLock:        &sync.Mutex{},
+		explanations:       make(map[string]map[int]ClaimExplanation),
+		releasesLock:       &sync.Mutex{},
+		releases:           make(map[string]map[int]int),
+		releasedHealth:     make(map[string]map[int]ClaimStatus),
+		messages:           make(chan *Message),
+		queueSlots:         make(chan struct{}, 1000),
+		queueBytes:         newQueueBudget(0),
+		queued:             make(chan struct{}, 1),
+		stopChan:           make(chan struct{}),
+		flushRequests:      make(chan struct{}, 1),
+		errorsLock:         &sync.Mutex{},
+		errorsChan:         make(chan error, errorsChanSize),
+		done:               make(chan struct{}),
+		deliveryDone:       make(chan struct{}),
 		topicClaimsChan:    make(chan map[string]bool, 1),
 		topicClaimsUpdated: make(chan struct{}, 1),
 	}
@@ -47,6 +64,7 @@ func NewTestConsumer(m *Marshaler, topics []string) *Consumer {
 	atomic.StoreInt32(cn.alive, 1)
 
 	go cn.sendTopicClaimsLoop()
+	go cn.deliveryLoop()
 
 	return cn
 }
@@ -605,6 +623,362 @@ func (s *ConsumerSuite) TestCommitByToken(c *C) {
 	c.Assert(cl.numTrackingOffsets(), Equals, 0)
 }
 
+func (s *ConsumerSuite) TestCommitTokenEncoding(c *C) {
+	token := CommitToken{topic: "test3", partID: 2, offset: 12345, claimID: "abc-1", epoch: 3}
+
+	data, err := token.MarshalBinary()
+	c.Assert(err, IsNil)
+	var decoded CommitToken
+	c.Assert(decoded.UnmarshalBinary(data), IsNil)
+	c.Assert(decoded, DeepEquals, token)
+	c.Assert(decoded.UnmarshalBinary(data[:len(data)-1]), NotNil)
+	c.Assert(decoded.UnmarshalBinary(append(data, 0)), NotNil)
+	c.Assert(decoded.UnmarshalBinary(nil), NotNil)
+
+	data, err = json.Marshal(token)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals,
+		`{"topic":"test3","partition":2,"offset":12345,"claim":"abc-1","epoch":3}`)
+	decoded = CommitToken{}
+	c.Assert(json.Unmarshal(data, &decoded), IsNil)
+	c.Assert(decoded, DeepEquals, token)
+}
+
+func (s *ConsumerSuite) TestCommitByTokenEarlierClaim(c *C) {
+	// A token survives serialization but not the claim it came from
+	s.Produce("test3", 0, "m1")
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	msg1 := <-s.cn.messages
+	data, err := msg1.CommitToken().MarshalBinary()
+	c.Assert(err, IsNil)
+
+	c.Assert(s.cn.claims["test3"][0].Release(), Equals, true)
+	c.Assert(s.kc.waitForRsteps(3), Equals, 3)
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	msg2 := <-s.cn.messages
+	c.Assert(msg2.Offset, Equals, msg1.Offset)
+
+	var token CommitToken
+	c.Assert(token.UnmarshalBinary(data), IsNil)
+	c.Assert(s.cn.CommitByToken(token), NotNil)
+	c.Assert(s.cn.CommitByToken(msg2.CommitToken()), IsNil)
+}
+
+func (s *ConsumerSuite) TestCommitEarlierClaim(c *C) {
+	// A message read under an earlier claim of the partition can't be committed, even
+	// though the new claim hasn't been repositioned, or Nacked
+	s.Produce("test3", 0, "m1")
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	msg1 := <-s.cn.messages
+
+	c.Assert(s.cn.claims["test3"][0].Release(), Equals, true)
+	c.Assert(s.kc.waitForRsteps(3), Equals, 3)
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	msg2 := <-s.cn.messages
+	c.Assert(msg2.Offset, Equals, msg1.Offset)
+
+	c.Assert(s.cn.Commit(msg1), NotNil)
+	c.Assert(s.cn.CommitAsync(msg1).Wait(), NotNil)
+	c.Assert(s.cn.CommitTx(msg1, func(int64) error {
+		c.Error("hook ran for a message from an earlier claim")
+		return nil
+	}), NotNil)
+	c.Assert(s.cn.Nack(msg1, time.Minute), NotNil)
+	cl := s.cn.claims["test3"][0]
+	cl.lock.RLock()
+	c.Assert(cl.tracking[msg2.Offset], Equals, false)
+	cl.lock.RUnlock()
+
+	c.Assert(s.cn.Commit(msg2), IsNil)
+}
+
+func (s *ConsumerSuite) TestCommitHandBuilt(c *C) {
+	// Messages that didn't come from a claim can't be committed
+	s.Produce("test3", 0, "m1")
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	msg := <-s.cn.messages
+
+	fake := &Message{Message: proto.Message{Topic: "test3", Partition: 0, Offset: msg.Offset}}
+	c.Assert(s.cn.Commit(fake), NotNil)
+	c.Assert(s.cn.Nack(fake, time.Minute), NotNil)
+	c.Assert(s.cn.Commit(&Message{}), NotNil)
+
+	c.Assert(s.cn.Commit(msg), IsNil)
+}
+
+func (s *ConsumerSuite) TestSeek(c *C) {
+	// Can't seek a partition we don't have
+	c.Assert(s.cn.Seek("test3", 0, 0), NotNil)
+
+	s.Produce("test3", 0, "m1", "m2", "m3", "m4", "m5")
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	msg1 := <-s.cn.messages
+	c.Assert(msg1.Offset, Equals, int64(0))
+
+	// Out of range seeks fail and leave us where we were
+	c.Assert(s.cn.Seek("test3", 0, 100), NotNil)
+	c.Assert(s.cn.Commit(msg1), IsNil)
+
+	// Rewind to 1 after consuming everything, the new position is heartbeated
+	for i := 1; i < 5; i++ {
+		<-s.cn.messages
+	}
+	c.Assert(s.cn.Seek("test3", 0, 1), IsNil)
+	for i := 0; i < 100 && s.m.GetPartitionClaim("test3", 0).CurrentOffset != 1; i++ {
+		time.Sleep(30 * time.Millisecond)
+	}
+	c.Assert(s.m.GetPartitionClaim("test3", 0).CurrentOffset, Equals, int64(1))
+
+	// We see the messages again, and the old copies can't be committed
+	msg2 := <-s.cn.messages
+	c.Assert(msg2.Value, DeepEquals, []byte("m2"))
+	c.Assert(s.cn.Commit(msg1), NotNil)
+	c.Assert(s.cn.Commit(msg2), IsNil)
+}
+
+func (s *ConsumerSuite) TestPause(c *C) {
+	// Can't pause a partition we don't have
+	c.Assert(s.cn.PausePartition("test3", 0), NotNil)
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	cl := s.cn.claims["test3"][0]
+
+	// Pausing the consumer pauses all of its claims
+	s.cn.Pause()
+	c.Assert(s.cn.Paused(), Equals, true)
+	c.Assert(cl.Paused(), Equals, true)
+	s.cn.Resume()
+	c.Assert(cl.Paused(), Equals, false)
+
+	// Partitions paused individually stay paused across a consumer resume
+	c.Assert(s.cn.PausePartition("test3", 0), IsNil)
+	s.cn.Pause()
+	s.cn.Resume()
+	c.Assert(cl.Paused(), Equals, true)
+	c.Assert(s.cn.ResumePartition("test3", 0), IsNil)
+	c.Assert(cl.Paused(), Equals, false)
+}
+
+func (s *ConsumerSuite) TestHealth(c *C) {
+	health := s.cn.Health()
+	c.Assert(health.Status, Equals, StatusHealthy)
+	c.Assert(health.Claims, HasLen, 0)
+
+	// A claim that hasn't been checked yet doesn't count against us
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	cl := s.cn.claims["test3"][0]
+	health = s.cn.Health()
+	c.Assert(health.Status, Equals, StatusHealthy)
+	c.Assert(health.Claims, HasLen, 1)
+	c.Assert(health.Claims[0].Status, Equals, StatusUnknown)
+
+	// One that is too slow makes us degraded
+	cl.lock.Lock()
+	cl.setHealth(StatusTooSlow, "too slow", cl.healthInputs(1, 2))
+	cl.lock.Unlock()
+	health = s.cn.Health()
+	c.Assert(health.Status, Equals, StatusDegraded)
+	c.Assert(health.Claims[0].Status, Equals, StatusTooSlow)
+	c.Assert(health.Claims[0].Inputs.PartitionVelocity, Equals, float64(2))
+
+	c.Assert(s.cn.Terminate(true), Equals, true)
+	health = s.cn.Health()
+	c.Assert(health.Status, Equals, StatusUnhealthy)
+	c.Assert(health.Reason, Equals, ErrConsumerTerminated.Error())
+}
+
+func (s *ConsumerSuite) TestHealthReleased(c *C) {
+	waitTerminated := func(cl *claim) {
+		for i := 0; i < 100 && !cl.Terminated(); i++ {
+			time.Sleep(30 * time.Millisecond)
+		}
+		c.Assert(cl.Terminated(), Equals, true)
+	}
+
+	// A claim released for an expired heartbeat is still reported once it's gone
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	cl := s.cn.claims["test3"][0]
+	cl.lock.Lock()
+	cl.lastHeartbeat = 0
+	cl.lock.Unlock()
+	c.Assert(cl.healthCheck(), Equals, false)
+	waitTerminated(cl)
+
+	health := s.cn.Health()
+	c.Assert(health.Status, Equals, StatusDegraded)
+	c.Assert(health.Claims, HasLen, 1)
+	c.Assert(health.Claims[0].Status, Equals, StatusHeartbeatExpired)
+	c.Assert(health.Claims[0].Released, Equals, true)
+
+	// Pausing the group releases our claims and shows on the consumer as a whole
+	c.Assert(s.cn.tryClaimPartition("test3", 1), Equals, true)
+	cl = s.cn.claims["test3"][1]
+	s.m.cluster.pauseConsumerGroup(s.m.GroupID(), "admin", time.Now().Add(time.Minute))
+	c.Assert(cl.healthCheck(), Equals, false)
+	waitTerminated(cl)
+
+	health = s.cn.Health()
+	c.Assert(health.Status, Equals, StatusGroupPaused)
+	c.Assert(health.Claims, HasLen, 2)
+	c.Assert(health.Claims[1].Partition, Equals, 1)
+	c.Assert(health.Claims[1].Status, Equals, StatusGroupPaused)
+	c.Assert(health.Claims[1].Released, Equals, true)
+}
+
+func (s *ConsumerSuite) TestFairDelivery(c *C) {
+	// A busy partition shouldn't starve a quiet one: once both have buffered messages
+	// we alternate between them
+	s.Produce("test3", 0, "m1", "m2", "m3", "m4", "m5", "m6", "m7", "m8", "m9", "m10")
+	s.Produce("test3", 1, "q1")
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	c.Assert(s.cn.tryClaimPartition("test3", 1), Equals, true)
+
+	buffered := func(cl *claim) int {
+		cl.lock.RLock()
+		defer cl.lock.RUnlock()
+		return len(cl.tracking)
+	}
+	cl0, cl1 := s.cn.claims["test3"][0], s.cn.claims["test3"][1]
+	for i := 0; i < 100 && (buffered(cl0) < 10 || buffered(cl1) < 1); i++ {
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	// At most one message from partition 0 can already be on its way before the round
+	// robin gets to partition 1
+	found := false
+	for i := 0; i < 3 && !found; i++ {
+		found = s.cn.consumeOne().Partition == 1
+	}
+	c.Assert(found, Equals, true)
+}
+
+func (s *ConsumerSuite) TestMaxQueueBytes(c *C) {
+	// With room for 5 bytes only one 3 byte message can be queued at a time
+	s.cn.queueBytes = newQueueBudget(5)
+	s.Produce("test3", 0, "abc", "def", "ghi")
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+
+	for i := 0; i < 100 && s.cn.Stats().QueuedBytes == 0; i++ {
+		time.Sleep(30 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	stats := s.cn.Stats()
+	c.Assert(stats.QueuedMessages, Equals, 1)
+	c.Assert(stats.QueuedBytes, Equals, int64(3))
+	c.Assert(stats.MaxQueuedBytes, Equals, int64(5))
+
+	// Consuming frees up the budget for the rest
+	c.Assert(s.cn.consumeOne().Value, DeepEquals, []byte("abc"))
+	c.Assert(s.cn.consumeOne().Value, DeepEquals, []byte("def"))
+	c.Assert(s.cn.consumeOne().Value, DeepEquals, []byte("ghi"))
+	for i := 0; i < 100 && s.cn.Stats().QueuedBytes != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.cn.Stats().QueuedBytes, Equals, int64(0))
+}
+
+func (s *ConsumerSuite) TestNoMessageQueue(c *C) {
+	// Without a queue messages are still delivered, one at a time
+	old := s.kc.options.MaxMessageQueue
+	s.kc.options.MaxMessageQueue = 0
+	defer func() { s.kc.options.MaxMessageQueue = old }()
+
+	cn, err := s.m.NewConsumer([]string{"test1"}, NewConsumerOptions())
+	c.Assert(err, IsNil)
+	defer cn.Terminate(true)
+	c.Assert(cn.Stats().MaxQueuedMessages, Equals, 1)
+
+	c.Assert(s.kc.waitForRsteps(2), Equals, 2)
+	s.Produce("test1", 0, "m1", "m2", "m3")
+	c.Assert(cn.consumeOne().Value, DeepEquals, []byte("m1"))
+	c.Assert(cn.consumeOne().Value, DeepEquals, []byte("m2"))
+	c.Assert(cn.consumeOne().Value, DeepEquals, []byte("m3"))
+}
+
+func (s *ConsumerSuite) TestFlushEveryNMessages(c *C) {
+	// After two commits the offset is recorded without waiting for a heartbeat
+	s.cn.options.FlushEveryNMessages = 2
+	go s.cn.flushLoop()
+	s.Produce("test3", 0, "m1", "m2", "m3")
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+
+	s.cn.consumeOne()
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(s.m.GetPartitionClaim("test3", 0).CurrentOffset, Equals, int64(0))
+
+	s.cn.consumeOne()
+	for i := 0; i < 100 && s.m.GetPartitionClaim("test3", 0).CurrentOffset != 2; i++ {
+		time.Sleep(30 * time.Millisecond)
+	}
+	c.Assert(s.m.GetPartitionClaim("test3", 0).CurrentOffset, Equals, int64(2))
+}
+
+func (s *ConsumerSuite) TestErrors(c *C) {
+	// Losing a claim is reported but the consumer carries on
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	cl := s.cn.claims["test3"][0]
+	cl.lock.Lock()
+	cl.lastHeartbeat -= HeartbeatInterval * 2
+	cl.lock.Unlock()
+	c.Assert(cl.healthCheck(), Equals, false)
+
+	select {
+	case err := <-s.cn.Errors():
+		lost, ok := err.(*ClaimLostError)
+		c.Assert(ok, Equals, true)
+		c.Assert(lost.Topic, Equals, "test3")
+		c.Assert(lost.Partition, Equals, 0)
+	case <-time.After(3 * time.Second):
+		c.Fatal("Timed out waiting for error.")
+	}
+	c.Assert(s.cn.Err(), IsNil)
+	select {
+	case <-s.cn.Done():
+		c.Fatal("Consumer done after losing a claim.")
+	default:
+	}
+
+	// A normal termination closes everything down
+	c.Assert(s.cn.Terminate(true), Equals, true)
+	<-s.cn.Done()
+	c.Assert(s.cn.Err(), Equals, ErrConsumerTerminated)
+	_, ok := <-s.cn.Errors()
+	c.Assert(ok, Equals, false)
+}
+
+func (s *ConsumerSuite) TestVisibilityTimeoutError(c *C) {
+	// A message that isn't committed in time is redelivered and reported
+	s.cn.options.VisibilityTimeout = 200 * time.Millisecond
+	s.Produce("test3", 0, "m1")
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	msg := <-s.cn.ConsumeChannel()
+	c.Assert(msg.DeliveryAttempt, Equals, 1)
+
+	select {
+	case err := <-s.cn.Errors():
+		vt, ok := err.(*VisibilityTimeoutError)
+		c.Assert(ok, Equals, true)
+		c.Assert(vt.Topic, Equals, "test3")
+		c.Assert(vt.Offset, Equals, msg.Offset)
+		c.Assert(vt.Attempt, Equals, 1)
+	case <-time.After(3 * time.Second):
+		c.Fatal("Timed out waiting for error.")
+	}
+	msg = <-s.cn.ConsumeChannel()
+	c.Assert(msg.DeliveryAttempt, Equals, 2)
+	c.Assert(s.cn.Commit(msg), IsNil)
+}
+
+func (s *ConsumerSuite) TestFatalError(c *C) {
+	// The first fatal error is what Err returns after termination
+	fenced := &FencedError{Topic: "test3", Partition: 1, Reason: "internal double-claim"}
+	s.cn.fail(fenced)
+	s.cn.fail(errors.New("second"))
+	c.Assert(s.cn.Err(), IsNil)
+	c.Assert(s.cn.Terminate(false), Equals, true)
+	c.Assert(<-s.cn.Errors(), Equals, fenced)
+	c.Assert(s.cn.Err(), Equals, fenced)
+}
+
 func (s *ConsumerSuite) TestTryClaimPartition(c *C) {
 	// Should work
 	c.Assert(s.cn.tryClaimPartition(s.cn.defaultTopic(), 0), Equals, true)
@@ -652,6 +1026,26 @@ func (s *ConsumerSuite) TestUnhealthyReclaim(c *C) {
 	c.Assert(cn.GetCurrentLoad(), Equals, 1)
 }
 
+func (s *ConsumerSuite) TestAloneReclaim(c *C) {
+	cn := NewTestConsumer(s.m, []string{"test1"})
+	defer cn.Terminate(true)
+	cn.options.ReclaimPolicy = AloneReclaimPolicy{}
+
+	// Nobody else in the group has claimed anything, so we reclaim straight away
+	c.Assert(cn.tryClaimPartition("test1", 0), Equals, true)
+	cn.claims["test1"][0].Release()
+	c.Assert(s.kc.waitForRsteps(3), Equals, 3)
+	cn.claimPartitions()
+	c.Assert(cn.GetCurrentLoad(), Equals, 1)
+
+	// But if somebody else is around we give them the chance
+	c.Assert(s.m2.ClaimPartition("test2", 0), Equals, true)
+	cn.claims["test1"][0].Release()
+	c.Assert(s.kc.waitForRsteps(7), Equals, 7)
+	cn.claimPartitions()
+	c.Assert(cn.GetCurrentLoad(), Equals, 0)
+}
+
 func (s *ConsumerSuite) TestFastReclaim(c *C) {
 	// Claim some partitions then create a new consumer with fast reclaim on; this
 	// should "reclaim" the partitions automatically at the offset they were last
@@ -729,6 +1123,43 @@ func (s *ConsumerSuite) TestMaximumClaims(c *C) {
 	c.Assert(s.cn.getNumActiveClaims(), Equals, 2)
 }
 
+func (s *ConsumerSuite) TestExplainClaims(c *C) {
+	exps := s.cn.ExplainClaims()
+	c.Assert(exps, HasLen, 3)
+	c.Assert(exps[2].Decision, Equals, DecisionNotConsidered)
+
+	// Somebody else has partition 1, we take 0 and then hit our limit
+	c.Assert(s.m2.ClaimPartition("test3", 1), Equals, true)
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	s.cn.lock.Lock()
+	s.cn.options.MaximumClaims = 1
+	s.cn.lock.Unlock()
+	s.cn.claimPartitions()
+
+	exps = s.cn.ExplainClaims()
+	c.Assert(exps, HasLen, 3)
+	c.Assert(exps[0].Decision, Equals, DecisionHeld)
+	c.Assert(exps[1].Decision, Equals, DecisionClaimedByOther)
+	c.Assert(exps[1].Owner, Equals, s.gr+"/cl2")
+	c.Assert(exps[2].Decision, Equals, DecisionClaimLimitReached)
+	c.Assert(exps[2].Reason, Equals, "already claimed the maximum of 1 partitions")
+
+	// Recently released partitions aren't reclaimed
+	s.cn.claims["test3"][0].Release()
+	c.Assert(s.kc.waitForRsteps(4), Equals, 4)
+	s.cn.lock.Lock()
+	s.cn.options.MaximumClaims = 0
+	s.cn.options.GreedyClaims = true
+	s.cn.lock.Unlock()
+	s.cn.claimPartitions()
+	exps = s.cn.ExplainClaims()
+	c.Assert(exps[0].Decision, Equals, DecisionRecentlyReleased)
+	c.Assert(exps[2].Decision, Equals, DecisionClaimed)
+
+	// And the snapshot carries the same
+	c.Assert(s.cn.Snapshot().Decisions, HasLen, 3)
+}
+
 func (s *ConsumerSuite) TestMaximumGreedyClaims(c *C) {
 	// Test the MaximumClaims option combined with GreedyClaims.
 	s.cn.lock.Lock()
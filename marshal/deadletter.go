@@ -0,0 +1,65 @@
+/*
+ * portal - marshal
+ *
+ * a library that implements an algorithm for doing consumer coordination within Kafka, rather
+ * than using Zookeeper or another external system.
+ *
+ */
+
+package marshal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DeadLetter describes where a message in the DeadLetterTopic came from. Kafka messages
+// have no headers, so this is carried in the key of the dead-lettered message, in front of
+// the original key: "topic/partition/offset/attempts/key". Use ParseDeadLetterKey to get
+// it back out.
+type DeadLetter struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Attempts  int
+	Key       []byte
+}
+
+// encodeKey returns the key to use for the dead-lettered message.
+func (d DeadLetter) encodeKey() []byte {
+	prefix := fmt.Sprintf("%s/%d/%d/%d/", d.Topic, d.Partition, d.Offset, d.Attempts)
+	return append([]byte(prefix), d.Key...)
+}
+
+// ParseDeadLetterKey decodes the key of a message from a DeadLetterTopic.
+func ParseDeadLetterKey(key []byte) (DeadLetter, error) {
+	parts := strings.SplitN(string(key), "/", 5)
+	if len(parts) != 5 {
+		return DeadLetter{}, fmt.Errorf("Invalid dead-letter key (length): [%s]", key)
+	}
+
+	partition, err := strconv.ParseInt(parts[1], 10, 32)
+	if err != nil {
+		return DeadLetter{}, fmt.Errorf("Invalid dead-letter key (partition): [%s]", key)
+	}
+	offset, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return DeadLetter{}, fmt.Errorf("Invalid dead-letter key (offset): [%s]", key)
+	}
+	attempts, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return DeadLetter{}, fmt.Errorf("Invalid dead-letter key (attempts): [%s]", key)
+	}
+
+	dl := DeadLetter{
+		Topic:     parts[0],
+		Partition: int32(partition),
+		Offset:    offset,
+		Attempts:  attempts,
+	}
+	if parts[4] != "" {
+		dl.Key = []byte(parts[4])
+	}
+	return dl, nil
+}
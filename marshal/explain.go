@@ -0,0 +1,168 @@
+/*
+ * portal - marshal
+ *
+ * a library that implements an algorithm for doing consumer coordination within Kafka, rather
+ * than using Zookeeper or another external system.
+ *
+ */
+
+package marshal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ClaimDecision is what a consumer last decided to do about a partition when looking for
+// partitions to claim.
+type ClaimDecision string
+
+const (
+	// DecisionClaimed means we claimed the partition.
+	DecisionClaimed ClaimDecision = "claimed"
+	// DecisionHeld means we already have the partition claimed.
+	DecisionHeld ClaimDecision = "held"
+	// DecisionClaimedByOther means somebody else has the partition claimed.
+	DecisionClaimedByOther ClaimDecision = "claimed_by_other"
+	// DecisionTopicOwnedByOther means that, in ClaimEntireTopic mode, somebody else has
+	// claimed the topic's key partition (partition 0).
+	DecisionTopicOwnedByOther ClaimDecision = "topic_owned_by_other"
+	// DecisionRecentlyReleased means we released the partition too recently to claim it
+	// again.
+	DecisionRecentlyReleased ClaimDecision = "recently_released"
+	// DecisionClaimLimitReached means we already have ConsumerOptions.MaximumClaims claims.
+	DecisionClaimLimitReached ClaimDecision = "claim_limit_reached"
+	// DecisionGroupPaused means the consumer group is paused by an Admin.
+	DecisionGroupPaused ClaimDecision = "group_paused"
+	// DecisionConsumerPaused means the consumer is paused, see Consumer.Pause.
+	DecisionConsumerPaused ClaimDecision = "consumer_paused"
+	// DecisionClaimFailed means we tried to claim the partition but didn't get it, usually
+	// because somebody else got there first.
+	DecisionClaimFailed ClaimDecision = "claim_failed"
+	// DecisionNotConsidered means we haven't looked at the partition yet.
+	DecisionNotConsidered ClaimDecision = "not_considered"
+)
+
+// ClaimExplanation is the last decision a consumer made about claiming a partition, and
+// why. Owner is the client that held the partition (or its topic) at the time, if anyone.
+type ClaimExplanation struct {
+	Topic     string        `json:"topic"`
+	Partition int           `json:"partition"`
+	Decision  ClaimDecision `json:"decision"`
+	Reason    string        `json:"reason,omitempty"`
+	Owner     string        `json:"owner,omitempty"`
+	DecidedAt time.Time     `json:"decided_at"`
+}
+
+// ExplainClaims returns, for every partition of the topics we consume, the last decision
+// we made about claiming it and why. It's the place to start when a consumer isn't
+// claiming the partitions you expect it to.
+func (c *Consumer) ExplainClaims() []ClaimExplanation {
+	partitions := c.partitionCounts()
+
+	c.explainLock.Lock()
+	defer c.explainLock.Unlock()
+
+	explanations := make([]ClaimExplanation, 0)
+	for topic, count := range partitions {
+		for partID := 0; partID < count; partID++ {
+			exp, ok := c.explanations[topic][partID]
+			if !ok {
+				exp = ClaimExplanation{Topic: topic, Partition: partID,
+					Decision: DecisionNotConsidered}
+			}
+			explanations = append(explanations, exp)
+		}
+	}
+	sort.Slice(explanations, func(i, j int) bool {
+		if explanations[i].Topic != explanations[j].Topic {
+			return explanations[i].Topic < explanations[j].Topic
+		}
+		return explanations[i].Partition < explanations[j].Partition
+	})
+	return explanations
+}
+
+// explain records a decision about claiming a partition. It must not be called with
+// explainLock held.
+func (c *Consumer) explain(topic string, partID int, decision ClaimDecision,
+	reason string) {
+
+	c.explainOwned(topic, partID, decision, reason, PartitionClaim{})
+}
+
+// explainOwned is explain for decisions made because of someone's claim.
+func (c *Consumer) explainOwned(topic string, partID int, decision ClaimDecision,
+	reason string, owner PartitionClaim) {
+
+	exp := ClaimExplanation{
+		Topic:     topic,
+		Partition: partID,
+		Decision:  decision,
+		Reason:    reason,
+		DecidedAt: time.Now(),
+	}
+	if owner.ClientID != "" {
+		exp.Owner = fmt.Sprintf("%s/%s", owner.GroupID, owner.ClientID)
+	}
+
+	c.explainLock.Lock()
+	defer c.explainLock.Unlock()
+
+	if c.explanations[topic] == nil {
+		c.explanations[topic] = make(map[int]ClaimExplanation)
+	}
+	c.explanations[topic][partID] = exp
+}
+
+// explainTopic records the same decision for every partition of a topic that isn't
+// claimed. Claimed partitions are recorded as held or claimed by someone else, unless the
+// decision is that the whole topic belongs to someone else.
+func (c *Consumer) explainTopic(topic string, partitions int, decision ClaimDecision,
+	reason string, owner PartitionClaim) {
+
+	for partID := 0; partID < partitions; partID++ {
+		if _, err := c.getActiveClaim(topic, partID); err == nil {
+			c.explain(topic, partID, DecisionHeld, "")
+			continue
+		}
+		if decision != DecisionTopicOwnedByOther {
+			if pc := c.marshal.GetPartitionClaim(topic, partID); pc.Claimed() {
+				c.explainClaimed(topic, partID, pc)
+				continue
+			}
+		}
+		c.explainOwned(topic, partID, decision, reason, owner)
+	}
+}
+
+// explainAll is explainTopic for all of our topics.
+func (c *Consumer) explainAll(decision ClaimDecision, reason string) {
+	for topic, partitions := range c.partitionCounts() {
+		c.explainTopic(topic, partitions, decision, reason, PartitionClaim{})
+	}
+}
+
+// explainClaimed records the decision for a partition that the Marshal topic says is
+// claimed, depending on whether it's us that has it.
+func (c *Consumer) explainClaimed(topic string, partID int, pc PartitionClaim) {
+	if pc.GroupID == c.marshal.groupID && pc.ClientID == c.marshal.clientID {
+		c.explain(topic, partID, DecisionHeld, "")
+		return
+	}
+	c.explainOwned(topic, partID, DecisionClaimedByOther,
+		fmt.Sprintf("claimed by %s/%s", pc.GroupID, pc.ClientID), pc)
+}
+
+// partitionCounts returns a copy of the number of partitions in each of our topics.
+func (c *Consumer) partitionCounts() map[string]int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	partitions := make(map[string]int, len(c.partitions))
+	for topic, count := range c.partitions {
+		partitions[topic] = count
+	}
+	return partitions
+}
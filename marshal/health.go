@@ -0,0 +1,304 @@
+/*
+ * portal - marshal
+ *
+ * a library that implements an algorithm for doing consumer coordination within Kafka, rather
+ * than using Zookeeper or another external system.
+ *
+ */
+
+package marshal
+
+import (
+	"fmt"
+	"time"
+)
+
+// HealthAction is what a HealthPolicy decides should happen to a claim.
+type HealthAction int
+
+const (
+	// HealthKeep means the claim is healthy.
+	HealthKeep HealthAction = iota
+	// HealthWarn means the claim is unhealthy, but not yet enough to give it up.
+	HealthWarn
+	// HealthRelease means the claim should be released so that another consumer can
+	// take over the partition.
+	HealthRelease
+)
+
+func (a HealthAction) String() string {
+	switch a {
+	case HealthKeep:
+		return "keep"
+	case HealthWarn:
+		return "warn"
+	case HealthRelease:
+		return "release"
+	default:
+		return fmt.Sprintf("HealthAction(%d)", int(a))
+	}
+}
+
+// ClaimHealth is the state of a claim that a HealthPolicy judges. Velocities are in
+// messages per heartbeat interval, averaged over the last ten heartbeats.
+type ClaimHealth struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+
+	Offsets             PartitionOffsets `json:"offsets"`
+	ConsumerVelocity    float64          `json:"consumer_velocity"`
+	PartitionVelocity   float64          `json:"partition_velocity"`
+	OutstandingMessages int              `json:"outstanding_messages"`
+	LastMessageTime     time.Time        `json:"last_message_time"`
+
+	// CyclesBehind is how many health checks in a row have ended in HealthWarn.
+	CyclesBehind int `json:"cycles_behind"`
+
+	// ReleaseIfBehind is false if the consumer's options say claims shouldn't be released
+	// for being slower than the partition (ConsumerOptions.ReleaseClaimsIfBehind is off,
+	// or ClaimEntireTopic is on).
+	ReleaseIfBehind bool `json:"release_if_behind"`
+}
+
+// Lag returns how many messages the claim is behind the end of the partition.
+func (h ClaimHealth) Lag() int64 {
+	if h.Offsets.Current < h.Offsets.Latest {
+		return h.Offsets.Latest - h.Offsets.Current
+	}
+	return 0
+}
+
+// TimeLag estimates how far behind the claim is in time: how long the partition took to
+// receive the messages we haven't consumed yet, going by its recent velocity. If nothing
+// has been produced recently, but we're still behind, it's the time since we last got a
+// message.
+func (h ClaimHealth) TimeLag() time.Duration {
+	lag := h.Lag()
+	if lag == 0 {
+		return 0
+	}
+	if h.PartitionVelocity <= 0 {
+		if h.LastMessageTime.IsZero() {
+			return 0
+		}
+		return time.Since(h.LastMessageTime)
+	}
+	return time.Duration(float64(lag) / h.PartitionVelocity *
+		float64(HeartbeatInterval*time.Second))
+}
+
+// CatchUpTime estimates how long the claim will take to reach the end of the partition,
+// going by how much faster it has recently been consuming than the partition is produced
+// to. It returns false if the claim is behind and not gaining on the partition.
+func (h ClaimHealth) CatchUpTime() (time.Duration, bool) {
+	lag := h.Lag()
+	if lag == 0 {
+		return 0, true
+	}
+	gain := h.ConsumerVelocity - h.PartitionVelocity
+	if gain <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(lag) / gain * float64(HeartbeatInterval*time.Second)), true
+}
+
+// HealthPolicy decides whether a claim is healthy. It's called with the claim locked once
+// per heartbeat, after Marshal's own checks (the heartbeat hasn't expired, the group isn't
+// paused, the claim isn't paused or rate limited), and returns an action and the reason
+// for it. Policies must be safe for use by many claims at once and must not block.
+type HealthPolicy interface {
+	CheckHealth(h ClaimHealth) (HealthAction, string)
+}
+
+// DefaultHealthPolicy is the health policy used unless ConsumerOptions.HealthPolicy is set.
+// A claim is released if it hasn't received a message for a heartbeat interval while
+// stuck behind, or if it is neither caught up (predicted to reach the end of the partition
+// within two heartbeats) nor consuming faster than the partition is produced to for three
+// health checks in a row.
+type DefaultHealthPolicy struct{}
+
+// CheckHealth implements HealthPolicy.
+func (DefaultHealthPolicy) CheckHealth(h ClaimHealth) (HealthAction, string) {
+	// If we haven't seen any messages for more than a heartbeat interval, it's possible
+	// we've gotten into a bad state. If we are behind and not seeing any messages then
+	// velocity has been 0 for long enough to drive the average to 0, which means about 10
+	// heartbeat cycles. This is long enough that releasing seems fine.
+	if time.Since(h.LastMessageTime) > HeartbeatInterval*time.Second &&
+		h.ConsumerVelocity == 0 &&
+		(h.PartitionVelocity > 0 || h.Offsets.Latest > h.Offsets.Current) {
+		return HealthRelease, fmt.Sprintf(
+			"no messages received for %d seconds with CV=%0.2f PV=%0.2f",
+			HeartbeatInterval, h.ConsumerVelocity, h.PartitionVelocity)
+	}
+
+	if !h.ReleaseIfBehind {
+		return HealthKeep, ""
+	}
+
+	// We consider a consumer to be caught up if the predicted offset is past the end
+	// of the partition. This takes into account the fact that we only get offset information
+	// every hearbeat, so we could have some stale data.
+	if h.Offsets.Current+int64(h.ConsumerVelocity*2) >= h.Offsets.Latest {
+		return HealthKeep, ""
+	}
+
+	// If the consumer is moving faster than the partition, consider it healthy. This is
+	// the standard catching up from behind case.
+	if h.PartitionVelocity < h.ConsumerVelocity {
+		return HealthKeep, fmt.Sprintf("catching up: consume ∆ %0.2f >= produce ∆ %0.2f",
+			h.ConsumerVelocity, h.PartitionVelocity)
+	}
+
+	if h.CyclesBehind+1 >= 3 {
+		return HealthRelease, fmt.Sprintf(
+			"too slow for too long: consume ∆ %0.2f < produce ∆ %0.2f",
+			h.ConsumerVelocity, h.PartitionVelocity)
+	}
+	return HealthWarn, fmt.Sprintf("too slow: consume ∆ %0.2f < produce ∆ %0.2f",
+		h.ConsumerVelocity, h.PartitionVelocity)
+}
+
+// LagThresholdPolicy releases a claim that has been more than MaxLag messages behind for
+// Cycles health checks in a row, warning until then. Unlike DefaultHealthPolicy it doesn't
+// look at velocities, so a consumer that is slow but keeping its lag bounded keeps its
+// claims. It ignores ClaimHealth.ReleaseIfBehind.
+type LagThresholdPolicy struct {
+	MaxLag int64
+	// Cycles defaults to 3.
+	Cycles int
+}
+
+// CheckHealth implements HealthPolicy.
+func (p LagThresholdPolicy) CheckHealth(h ClaimHealth) (HealthAction, string) {
+	lag := h.Lag()
+	if lag <= p.MaxLag {
+		return HealthKeep, ""
+	}
+	reason := fmt.Sprintf("lag of %d messages exceeds %d", lag, p.MaxLag)
+	return thresholdAction(h, p.Cycles), reason
+}
+
+// TimeLagPolicy is like LagThresholdPolicy, but judges claims by how far behind they are
+// in time, as estimated by ClaimHealth.TimeLag. If MaxCatchUpTime is set, a claim is also
+// over the threshold if ClaimHealth.CatchUpTime predicts it won't catch up within that.
+type TimeLagPolicy struct {
+	MaxTimeLag     time.Duration
+	MaxCatchUpTime time.Duration
+	// Cycles defaults to 3.
+	Cycles int
+}
+
+// CheckHealth implements HealthPolicy.
+func (p TimeLagPolicy) CheckHealth(h ClaimHealth) (HealthAction, string) {
+	lag := h.TimeLag()
+	if lag > p.MaxTimeLag {
+		reason := fmt.Sprintf("time lag of %s exceeds %s",
+			lag.Truncate(time.Second), p.MaxTimeLag)
+		return thresholdAction(h, p.Cycles), reason
+	}
+
+	if p.MaxCatchUpTime > 0 {
+		catchUp, ok := h.CatchUpTime()
+		if !ok {
+			return thresholdAction(h, p.Cycles), fmt.Sprintf(
+				"not catching up: consume ∆ %0.2f <= produce ∆ %0.2f",
+				h.ConsumerVelocity, h.PartitionVelocity)
+		}
+		if catchUp > p.MaxCatchUpTime {
+			return thresholdAction(h, p.Cycles), fmt.Sprintf(
+				"time to catch up of %s exceeds %s",
+				catchUp.Truncate(time.Second), p.MaxCatchUpTime)
+		}
+	}
+	return HealthKeep, ""
+}
+
+// thresholdAction returns the action for a claim that is over a threshold: release once
+// it has been for cycles checks in a row, otherwise warn.
+func thresholdAction(h ClaimHealth, cycles int) HealthAction {
+	if cycles <= 0 {
+		cycles = 3
+	}
+	if h.CyclesBehind+1 >= cycles {
+		return HealthRelease
+	}
+	return HealthWarn
+}
+
+// HealthStatus describes the health of a claim, or of a consumer as a whole.
+type HealthStatus string
+
+// The statuses a claim can be in after a health check.
+const (
+	// StatusHealthy means the claim is caught up, or close enough to it.
+	StatusHealthy HealthStatus = "healthy"
+	// StatusCatchingUp means the claim is behind, but the health policy is happy with
+	// how it's progressing.
+	StatusCatchingUp HealthStatus = "catching_up"
+	// StatusTooSlow means the health policy has warned about or released the claim
+	// while it was still consuming. ClaimStatus.Warnings counts the warnings in a row.
+	StatusTooSlow HealthStatus = "too_slow"
+	// StatusStalled means the claim was released while it wasn't consuming at all.
+	StatusStalled HealthStatus = "stalled"
+	// StatusHeartbeatExpired means the claim wasn't heartbeated in time and is being
+	// released.
+	StatusHeartbeatExpired HealthStatus = "heartbeat_expired"
+	// StatusGroupPaused means the consumer group is paused by an Admin.
+	StatusGroupPaused HealthStatus = "group_paused"
+	// StatusPaused means the claim or its consumer is paused.
+	StatusPaused HealthStatus = "paused"
+	// StatusRateLimited means the claim is being held back by ConsumerOptions.RateLimit,
+	// so its velocity isn't judged.
+	StatusRateLimited HealthStatus = "rate_limited"
+	// StatusUnknown means the claim hasn't been health checked yet.
+	StatusUnknown HealthStatus = "unknown"
+)
+
+// The overall statuses of a consumer.
+const (
+	// StatusDegraded means at least one claim is too slow, stalled or has an expired
+	// heartbeat.
+	StatusDegraded HealthStatus = "degraded"
+	// StatusUnhealthy means the consumer has terminated.
+	StatusUnhealthy HealthStatus = "unhealthy"
+)
+
+// ClaimStatus is the outcome of the last health check of a claim.
+type ClaimStatus struct {
+	Topic     string       `json:"topic"`
+	Partition int          `json:"partition"`
+	Status    HealthStatus `json:"status"`
+	Reason    string       `json:"reason,omitempty"`
+
+	// Warnings is how many health checks in a row have found the claim too slow.
+	Warnings int `json:"warnings"`
+
+	// CheckedAt is when the check happened, and Inputs what it was based on. They're
+	// zero if the claim hasn't been checked yet.
+	CheckedAt time.Time   `json:"checked_at"`
+	Inputs    ClaimHealth `json:"inputs"`
+
+	// Released is set if the claim has since been released because of this status.
+	Released bool `json:"released,omitempty"`
+}
+
+// releasedHealthTTL is how long Consumer.Health keeps reporting the status of a claim
+// that a health check released.
+const releasedHealthTTL = 5 * HeartbeatInterval * time.Second
+
+// degraded returns whether this claim status makes its consumer degraded.
+func (s ClaimStatus) degraded() bool {
+	switch s.Status {
+	case StatusTooSlow, StatusStalled, StatusHeartbeatExpired:
+		return true
+	}
+	return false
+}
+
+// ConsumerHealth is returned by Consumer.Health. Status is StatusHealthy, StatusDegraded,
+// StatusGroupPaused or StatusUnhealthy, and Reason says why if it isn't healthy.
+type ConsumerHealth struct {
+	Status HealthStatus  `json:"status"`
+	Reason string        `json:"reason,omitempty"`
+	Claims []ClaimStatus `json:"claims"`
+}
@@ -0,0 +1,111 @@
+package marshal
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&HealthSuite{})
+
+type HealthSuite struct{}
+
+func (s *HealthSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *HealthSuite) TestDefaultHealthPolicy(c *C) {
+	p := DefaultHealthPolicy{}
+	h := ClaimHealth{
+		Offsets:           PartitionOffsets{Current: 10, Latest: 100},
+		ConsumerVelocity:  1,
+		PartitionVelocity: 5,
+		LastMessageTime:   time.Now(),
+		ReleaseIfBehind:   true,
+	}
+
+	// Slower than the partition, warn until the third time
+	action, _ := p.CheckHealth(h)
+	c.Assert(action, Equals, HealthWarn)
+	h.CyclesBehind = 2
+	action, _ = p.CheckHealth(h)
+	c.Assert(action, Equals, HealthRelease)
+
+	// Unless we're allowed to be behind
+	h.ReleaseIfBehind = false
+	action, _ = p.CheckHealth(h)
+	c.Assert(action, Equals, HealthKeep)
+
+	// But being wedged always releases
+	h.ConsumerVelocity = 0
+	h.LastMessageTime = time.Now().Add(-(HeartbeatInterval + 1) * time.Second)
+	action, reason := p.CheckHealth(h)
+	c.Assert(action, Equals, HealthRelease)
+	c.Assert(reason, Matches, "no messages received.*")
+
+	// Catching up is fine
+	h = ClaimHealth{
+		Offsets:           PartitionOffsets{Current: 10, Latest: 100},
+		ConsumerVelocity:  10,
+		PartitionVelocity: 5,
+		LastMessageTime:   time.Now(),
+		ReleaseIfBehind:   true,
+	}
+	action, reason = p.CheckHealth(h)
+	c.Assert(action, Equals, HealthKeep)
+	c.Assert(reason, Matches, "catching up.*")
+}
+
+func (s *HealthSuite) TestTimeLagPolicy(c *C) {
+	// 60 messages behind a partition getting 6 messages per heartbeat is 10 heartbeats
+	h := ClaimHealth{
+		Offsets:           PartitionOffsets{Current: 40, Latest: 100},
+		PartitionVelocity: 6,
+	}
+	c.Assert(h.Lag(), Equals, int64(60))
+	c.Assert(h.TimeLag(), Equals, 10*HeartbeatInterval*time.Second)
+
+	p := TimeLagPolicy{MaxTimeLag: time.Hour}
+	action, _ := p.CheckHealth(h)
+	c.Assert(action, Equals, HealthKeep)
+
+	p.MaxTimeLag = time.Minute
+	action, reason := p.CheckHealth(h)
+	c.Assert(action, Equals, HealthWarn)
+	c.Assert(reason, Equals, "time lag of 10m0s exceeds 1m0s")
+	h.CyclesBehind = 2
+	action, _ = p.CheckHealth(h)
+	c.Assert(action, Equals, HealthRelease)
+
+	// Caught up means no time lag
+	h.Offsets.Current = 100
+	c.Assert(h.TimeLag(), Equals, time.Duration(0))
+}
+
+func (s *HealthSuite) TestCatchUpTime(c *C) {
+	// 60 messages behind, gaining 3 messages per heartbeat is 20 heartbeats
+	h := ClaimHealth{
+		Offsets:           PartitionOffsets{Current: 40, Latest: 100},
+		ConsumerVelocity:  9,
+		PartitionVelocity: 6,
+	}
+	catchUp, ok := h.CatchUpTime()
+	c.Assert(ok, Equals, true)
+	c.Assert(catchUp, Equals, 20*HeartbeatInterval*time.Second)
+
+	p := TimeLagPolicy{MaxTimeLag: time.Hour, MaxCatchUpTime: time.Hour}
+	action, _ := p.CheckHealth(h)
+	c.Assert(action, Equals, HealthKeep)
+	p.MaxCatchUpTime = time.Minute
+	action, reason := p.CheckHealth(h)
+	c.Assert(action, Equals, HealthWarn)
+	c.Assert(reason, Equals, "time to catch up of 20m0s exceeds 1m0s")
+
+	// Not gaining at all
+	h.ConsumerVelocity = 6
+	_, ok = h.CatchUpTime()
+	c.Assert(ok, Equals, false)
+	p.MaxCatchUpTime = time.Hour
+	action, _ = p.CheckHealth(h)
+	c.Assert(action, Equals, HealthWarn)
+}
@@ -1,39 +1,156 @@
 /*
  * portal - marshal
  *
- * this package exists for the simple reason that go vet complains bitterly
- * that the go-logging package we use named its error printer 'Error' without
- * the trailing 'f', and yet it accepts a format string. blah.
+ * a library that implements an algorithm for doing consumer coordination within Kafka, rather
+ * than using Zookeeper or another external system.
  *
  */
 
 package marshal
 
 import (
+	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/op/go-logging"
 )
 
-var log *logging.Logger
+// Logger is what Marshal logs through. Each call takes a short, constant message followed by
+// alternating keys and values giving the details, such as "topic", "test", "partition", 3.
+// The standard library's *slog.Logger implements this directly; use NewGoLoggingLogger to
+// log through go-logging.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// logger wraps the configured Logger with printf style helpers, for the few places (such as
+// the state dumps) where a formatted message reads better than fields. A go-logging Logger
+// is called directly, so that it reports the right caller.
+type logger struct {
+	Logger
+}
+
+func (l logger) Debugf(format string, args ...interface{}) {
+	if g, ok := l.Logger.(*goLoggingLogger); ok {
+		g.l.Debugf(format, args...)
+		return
+	}
+	l.Debug(fmt.Sprintf(format, args...))
+}
+
+func (l logger) Infof(format string, args ...interface{}) {
+	if g, ok := l.Logger.(*goLoggingLogger); ok {
+		g.l.Infof(format, args...)
+		return
+	}
+	l.Info(fmt.Sprintf(format, args...))
+}
+
+func (l logger) Warningf(format string, args ...interface{}) {
+	if g, ok := l.Logger.(*goLoggingLogger); ok {
+		g.l.Warningf(format, args...)
+		return
+	}
+	l.Warn(fmt.Sprintf(format, args...))
+}
+
+func (l logger) Errorf(format string, args ...interface{}) {
+	if g, ok := l.Logger.(*goLoggingLogger); ok {
+		g.l.Errorf(format, args...)
+		return
+	}
+	l.Error(fmt.Sprintf(format, args...))
+}
+
+var log logger
 var logMu = &sync.Mutex{}
 
 func init() {
 	logMu.Lock()
 	defer logMu.Unlock()
 
-	if log != nil {
+	if log.Logger != nil {
 		return
 	}
-	log = logging.MustGetLogger("KafkaMarshal")
+	log = logger{NewGoLoggingLogger(logging.MustGetLogger("KafkaMarshal"))}
 	logging.SetLevel(logging.INFO, "KafkaMarshal")
 }
 
-// SetLogger can be called with a logging.Logger in order to overwrite our internal
-// logger. Useful if you need to control the logging (such as in tests).
-func SetLogger(l *logging.Logger) {
+// SetLogger can be called with a Logger in order to overwrite our internal logger. Useful
+// if you need to control the logging (such as in tests). To keep using a go-logging
+// Logger, pass it through NewGoLoggingLogger.
+func SetLogger(l Logger) {
 	logMu.Lock()
 	defer logMu.Unlock()
 
-	log = l
+	log = logger{l}
+}
+
+// goLoggingLogger adapts a go-logging Logger, which has no notion of fields, to Logger.
+// l is a copy of the Logger we were given, with ExtraCalldepth raised by one so that
+// go-logging skips our frame when it reports the caller.
+type goLoggingLogger struct {
+	l *logging.Logger
+}
+
+// NewGoLoggingLogger returns a Logger that logs to a go-logging Logger. Fields are appended
+// to the message as key=value pairs. It logs through a copy of l, so later changes to l,
+// such as calling its SetBackend, aren't seen; changes to go-logging's default backend
+// and levels are.
+func NewGoLoggingLogger(l *logging.Logger) Logger {
+	wrapped := *l
+	wrapped.ExtraCalldepth++
+	return &goLoggingLogger{l: &wrapped}
+}
+
+func (g *goLoggingLogger) Debug(msg string, keyvals ...interface{}) {
+	g.l.Debugf("%s", formatFields(msg, keyvals))
+}
+
+func (g *goLoggingLogger) Info(msg string, keyvals ...interface{}) {
+	g.l.Infof("%s", formatFields(msg, keyvals))
+}
+
+func (g *goLoggingLogger) Warn(msg string, keyvals ...interface{}) {
+	g.l.Warningf("%s", formatFields(msg, keyvals))
+}
+
+func (g *goLoggingLogger) Error(msg string, keyvals ...interface{}) {
+	g.l.Errorf("%s", formatFields(msg, keyvals))
+}
+
+// formatFields renders a message and its fields as a single line, quoting values that
+// contain spaces. A trailing key without a value is logged with the value "MISSING".
+func formatFields(msg string, keyvals []interface{}) string {
+	if len(keyvals) == 0 {
+		return msg
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "MISSING"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		str := fmt.Sprint(value)
+		if str == "" || strings.ContainsAny(str, " \t\n\"=") {
+			str = fmt.Sprintf("%q", str)
+		}
+		fmt.Fprintf(&b, " %v=%s", keyvals[i], str)
+	}
+	return b.String()
+}
+
+// partitionFields returns the fields identifying a partition claimed by a Marshaler,
+// followed by keyvals.
+func partitionFields(m *Marshaler, topic string, partID int,
+	keyvals ...interface{}) []interface{} {
+
+	return append([]interface{}{"group", m.groupID, "client", m.clientID,
+		"topic", topic, "partition", partID}, keyvals...)
 }
@@ -0,0 +1,22 @@
+//go:build go1.21
+
+/*
+ * portal - marshal
+ *
+ * a library that implements an algorithm for doing consumer coordination within Kafka, rather
+ * than using Zookeeper or another external system.
+ *
+ */
+
+package marshal
+
+import "log/slog"
+
+// NewSlogLogger returns a Logger that logs to a log/slog Logger, or to slog's default
+// Logger if l is nil. Fields are passed through as slog attributes.
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
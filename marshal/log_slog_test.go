@@ -0,0 +1,18 @@
+//go:build go1.21
+
+package marshal
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *LogSuite) TestSlogLogger(c *C) {
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+	l.Info("claimed", "topic", "test1", "partition", 3)
+	c.Assert(strings.Contains(buf.String(), "msg=claimed topic=test1 partition=3"), Equals, true)
+}
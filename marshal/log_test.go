@@ -1,6 +1,9 @@
 package marshal
 
 import (
+	"bytes"
+	"errors"
+	"strings"
 	"sync"
 
 	"github.com/dropbox/kafka"
@@ -26,11 +29,12 @@ func init() {
 	leveledLogger.SetLevel(logging.DEBUG, "KafkaClient")
 	leveledLogger.SetLevel(logging.DEBUG, "KafkaTest")
 
-	log = logging.MustGetLogger("KafkaMarshal")
-	log.SetBackend(leveledLogger)
+	l := logging.MustGetLogger("KafkaMarshal")
+	l.SetBackend(leveledLogger)
+	log = logger{NewGoLoggingLogger(l)}
 
-	kafkatest.SetLogger(log)
-	kafka.SetLogger(log)
+	kafkatest.SetLogger(l)
+	kafka.SetLogger(l)
 }
 
 func (l *logTestBackend) SetC(c *C) {
@@ -51,3 +55,37 @@ func (l *logTestBackend) Log(lvl logging.Level, cd int, rec *logging.Record) err
 	l.c.Log(rec.Formatted(cd))
 	return nil
 }
+
+var _ = Suite(&LogSuite{})
+
+type LogSuite struct{}
+
+func (s *LogSuite) TestFormatFields(c *C) {
+	c.Assert(formatFields("message", nil), Equals, "message")
+	c.Assert(formatFields("claimed", []interface{}{"topic", "test1", "partition", 3}),
+		Equals, "claimed topic=test1 partition=3")
+	c.Assert(formatFields("failed", []interface{}{"err", errors.New("no route"), "x", ""}),
+		Equals, `failed err="no route" x=""`)
+	c.Assert(formatFields("odd", []interface{}{"key"}), Equals, "odd key=MISSING")
+}
+
+func (s *LogSuite) TestGoLoggingCaller(c *C) {
+	// go-logging reports where we logged from, not our adapter
+	var buf bytes.Buffer
+	backend := logging.NewBackendFormatter(logging.NewLogBackend(&buf, "", 0),
+		logging.MustStringFormatter("%{shortfile} %{message}"))
+	l := logging.MustGetLogger("KafkaMarshalCaller")
+	l.SetBackend(logging.AddModuleLevel(backend))
+
+	gl := logger{NewGoLoggingLogger(l)}
+	gl.Info("fields", "k", "v")
+	gl.Infof("formatted %d", 1)
+	c.Assert(l.ExtraCalldepth, Equals, 0)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(strings.HasPrefix(lines[0], "log_test.go:"), Equals, true)
+	c.Assert(strings.HasSuffix(lines[0], "fields k=v"), Equals, true)
+	c.Assert(strings.HasPrefix(lines[1], "log_test.go:"), Equals, true)
+	c.Assert(strings.HasSuffix(lines[1], "formatted 1"), Equals, true)
+}
@@ -9,6 +9,7 @@
 package marshal
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -85,6 +86,17 @@ func (m *Marshaler) addNewConsumer(c *Consumer) {
 	m.consumers = append(m.consumers, c)
 }
 
+// consumerList returns a copy of our consumers, so they can be operated on without holding
+// our lock.
+func (m *Marshaler) consumerList() []*Consumer {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	consumers := make([]*Consumer, len(m.consumers))
+	copy(consumers, m.consumers)
+	return consumers
+}
+
 // removeConsumer is called when a Consumer is terminating and should be removed from our list.
 func (m *Marshaler) removeConsumer(c *Consumer) {
 	m.lock.Lock()
@@ -117,7 +129,9 @@ func (m *Marshaler) getClaimedPartitionState(topicName string, partID int) (
 	// And if it's not claimed by us...
 	if topic.partitions[partID].GroupID != m.groupID ||
 		topic.partitions[partID].ClientID != m.clientID {
-		return nil, fmt.Errorf("Partition %s:%d is not claimed by us!", topicName, partID)
+		return nil, &FencedError{Topic: topicName, Partition: partID,
+			Reason: fmt.Sprintf("claimed by %s/%s", topic.partitions[partID].GroupID,
+				topic.partitions[partID].ClientID)}
 	}
 
 	return topic, nil
@@ -215,8 +229,11 @@ func (m *Marshaler) GetLastPartitionClaim(topicName string, partID int) Partitio
 // GetPartitionOffsets returns the current state of a topic/partition. This has to hit Kafka
 // thrice to ask about a partition, but it returns the full state of information that can be
 // used to calculate consumer lag.
-func (m *Marshaler) GetPartitionOffsets(topicName string, partID int) (PartitionOffsets, error) {
-	var err error
+func (m *Marshaler) GetPartitionOffsets(topicName string,
+	partID int) (_ PartitionOffsets, err error) {
+
+	span := m.startSpan(TraceGetPartitionOffsets, topicName, partID)
+	defer func() { span.End(err) }()
 
 	o := PartitionOffsets{}
 	o.Earliest, err = m.cluster.broker.OffsetEarliest(topicName, int32(partID))
@@ -263,6 +280,10 @@ func (m *Marshaler) msgBase(topicName string, partID int) *msgBase {
 // want to use a MarshaledConsumer. Returns a bool on whether or not the claim succeeded and
 // whether you can continue.
 func (m *Marshaler) ClaimPartition(topicName string, partID int) bool {
+	span := m.startSpan(TraceClaimPartition, topicName, partID)
+	var spanErr error
+	defer func() { span.End(spanErr) }()
+
 	topic := m.cluster.getPartitionState(m.groupID, topicName, partID)
 
 	// Unlock is later, since this function might take a while
@@ -276,10 +297,16 @@ func (m *Marshaler) ClaimPartition(topicName string, partID int) bool {
 			topic.partitions[partID].ClientID == m.clientID {
 			return true
 		}
-		log.Warningf("Attempt to claim already claimed partition.")
+		log.Warn("attempt to claim already claimed partition",
+			partitionFields(m, topicName, partID)...)
+		spanErr = errors.New("partition already claimed")
 		return false
 	}
 
+	labels := partitionLabels(m.groupID, topicName, partID)
+	m.cluster.metrics.inc(metricClaimAttempts, labels)
+	defer m.cluster.metrics.since(metricClaimSeconds, groupLabels(m.groupID), time.Now())
+
 	// Make a channel for results, append it to the list so we hear about claims
 	out := make(chan struct{}, 1)
 	topic.partitions[partID].pendingClaims = append(
@@ -295,9 +322,13 @@ func (m *Marshaler) ClaimPartition(topicName string, partID int) bool {
 	if err != nil {
 		// If we failed to produce, this is probably serious so we should undo the work
 		// we did and then return failure
-		log.Errorf("Failed to produce to Kafka: %s", err)
+		log.Error("failed to produce claim to Kafka",
+			partitionFields(m, topicName, partID, "err", err)...)
+		m.cluster.metrics.inc(metricClaimFailures, labels)
+		spanErr = err
 		return false
 	}
+	span.Event("produced")
 
 	// Wait for channel to close, which is the signal that the rationalizer has
 	// updated the status.
@@ -307,6 +338,11 @@ func (m *Marshaler) ClaimPartition(topicName string, partID int) bool {
 	// is ours. nil = not.
 	topic, err = m.getClaimedPartitionState(topicName, partID)
 	if topic == nil || err != nil {
+		m.cluster.metrics.inc(metricClaimFailures, labels)
+		spanErr = err
+		if spanErr == nil {
+			spanErr = errors.New("partition claimed by another client")
+		}
 		return false
 	}
 	return true
@@ -316,48 +352,139 @@ func (m *Marshaler) ClaimPartition(topicName string, partID int) bool {
 // still owning this partition. Returns an error if anything has gone wrong (at which
 // point we can no longer assert we have the lock).
 func (m *Marshaler) Heartbeat(topicName string, partID int, offset int64) error {
-	topic, err := m.getClaimedPartitionState(topicName, partID)
-	if err != nil {
-		return err
+	_, err := m.heartbeat(topicName, partID, offset)
+	return err
+}
+
+// heartbeat is Heartbeat, but also returns whether the offset was committed to Kafka.
+func (m *Marshaler) heartbeat(topicName string, partID int, offset int64) (bool, error) {
+	result := m.heartbeats([]partitionOffset{{topicName, partID, offset}})[0]
+	return result.committed, result.err
+}
+
+// partitionOffset is an offset to heartbeat for a partition.
+type partitionOffset struct {
+	topic  string
+	partID int
+	offset int64
+}
+
+// heartbeatResult is the outcome of heartbeating one partitionOffset. committed is whether
+// the offset was also committed to Kafka.
+type heartbeatResult struct {
+	committed bool
+	err       error
+}
+
+// heartbeats sends heartbeats for several partitions at once. The heartbeats going to the
+// same Marshal topic partition are produced together, so this costs one produce for each
+// of those rather than one for each partition. Returns a result for each input.
+func (m *Marshaler) heartbeats(beats []partitionOffset) []heartbeatResult {
+	var span Span
+	if len(beats) == 1 {
+		span = m.startSpan(TraceHeartbeat, beats[0].topic, beats[0].partID,
+			"offset", beats[0].offset)
+	} else {
+		span = m.cluster.startSpan(TraceHeartbeat, "group", m.groupID, "client", m.clientID,
+			"partitions", len(beats))
 	}
 
-	// Attempt to commit offset, this is best-effort and we don't care if it fails
-	// since the canonical storage is in the heartbeat
-	if err := m.CommitOffsets(topicName, partID, offset); err != nil {
-		log.Warningf("[%s:%d] failed to commit offset during heartbeat: %s",
-			topicName, partID, err)
+	results := make([]heartbeatResult, len(beats))
+	batches := make(map[int][]int)
+	for i, beat := range beats {
+		topic, err := m.getClaimedPartitionState(beat.topic, beat.partID)
+		if err != nil {
+			results[i].err = err
+			continue
+		}
+
+		// Attempt to commit offset, this is best-effort and we don't care if it fails
+		// since the canonical storage is in the heartbeat
+		if err := m.CommitOffsets(beat.topic, beat.partID, beat.offset); err != nil {
+			log.Warn("failed to commit offset during heartbeat",
+				partitionFields(m, beat.topic, beat.partID, "err", err)...)
+		} else {
+			results[i].committed = true
+		}
+		batches[topic.claimPartition] = append(batches[topic.claimPartition], i)
 	}
 
 	// All good, let's heartbeat
-	cl := &msgHeartbeat{
-		msgBase:       *m.msgBase(topicName, partID),
-		CurrentOffset: offset,
+	start := time.Now()
+	for claimPartition, idxs := range batches {
+		msgs := make([]*proto.Message, 0, len(idxs))
+		for _, i := range idxs {
+			cl := &msgHeartbeat{
+				msgBase:       *m.msgBase(beats[i].topic, beats[i].partID),
+				CurrentOffset: beats[i].offset,
+			}
+			msgs = append(msgs, &proto.Message{Value: []byte(cl.Encode())})
+		}
+
+		_, err := m.cluster.producer.Produce(MarshalTopic, int32(claimPartition), msgs...)
+		if err != nil {
+			for _, i := range idxs {
+				log.Error("failed to send heartbeat message to Kafka",
+					partitionFields(m, beats[i].topic, beats[i].partID, "err", err)...)
+				results[i] = heartbeatResult{
+					err: fmt.Errorf("Failed to produce heartbeat to Kafka: %s", err),
+				}
+			}
+		}
 	}
-	_, err = m.cluster.producer.Produce(MarshalTopic, int32(topic.claimPartition),
-		&proto.Message{Value: []byte(cl.Encode())})
-	if err != nil {
-		log.Errorf("[%s:%d] failed to send heartbeat message to Kafka: %s",
-			topicName, partID, err)
-		return fmt.Errorf("Failed to produce heartbeat to Kafka: %s", err)
+	if len(batches) > 0 {
+		m.cluster.metrics.since(metricHeartbeatSeconds, groupLabels(m.groupID), start)
 	}
 
-	return nil
+	var spanErr error
+	for i, beat := range beats {
+		labels := partitionLabels(m.groupID, beat.topic, beat.partID)
+		m.cluster.metrics.inc(metricHeartbeats, labels)
+		if results[i].err != nil {
+			m.cluster.metrics.inc(metricHeartbeatFailures, labels)
+			if spanErr == nil {
+				spanErr = results[i].err
+			}
+		}
+	}
+	span.End(spanErr)
+	return results
 }
 
 // ReleasePartition will send an update for other people to know that we're done with
 // a partition. Returns an error if anything has gone wrong (at which
 // point we can no longer assert we have the lock).
 func (m *Marshaler) ReleasePartition(topicName string, partID int, offset int64) error {
+	_, err := m.releasePartition(topicName, partID, offset)
+	return err
+}
+
+// releasePartition is ReleasePartition, but also returns whether the offset was committed
+// to Kafka.
+func (m *Marshaler) releasePartition(topicName string, partID int,
+	offset int64) (committed bool, err error) {
+
+	span := m.startSpan(TraceReleasePartition, topicName, partID, "offset", offset)
+	defer func() {
+		span.End(err)
+		if err != nil {
+			m.cluster.metrics.inc(metricReleaseFailures,
+				partitionLabels(m.groupID, topicName, partID))
+		}
+	}()
+
 	topic, err := m.getClaimedPartitionState(topicName, partID)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// Commit our offset first; if this fails, we can still try to release,
 	// but we should advise
+	committed = true
 	if err := m.CommitOffsets(topicName, partID, offset); err != nil {
-		log.Warningf("[%s:%d] failed to commit offset during release: %s",
-			topicName, partID, err)
+		log.Warn("failed to commit offset during release",
+			partitionFields(m, topicName, partID, "err", err)...)
+		committed = false
 	}
 
 	// All good, let's release
@@ -368,11 +495,34 @@ func (m *Marshaler) ReleasePartition(topicName string, partID int, offset int64)
 	_, err = m.cluster.producer.Produce(MarshalTopic, int32(topic.claimPartition),
 		&proto.Message{Value: []byte(cl.Encode())})
 	if err != nil {
-		log.Errorf("[%s:%d] failed to send release message to Kafka: %s",
-			topicName, partID, err)
-		return fmt.Errorf("Failed to produce release to Kafka: %s", err)
+		log.Error("failed to send release message to Kafka",
+			partitionFields(m, topicName, partID, "err", err)...)
+		return false, fmt.Errorf("Failed to produce release to Kafka: %s", err)
+	}
+
+	m.cluster.metrics.inc(metricReleases, partitionLabels(m.groupID, topicName, partID))
+	return committed, nil
+}
+
+// recordSkip tells the rest of the group that we skipped offsets from..to-1 of a partition
+// that we have claimed, so the range is recorded in the Marshal topic. It shows up in
+// PartitionClaim.SkippedFrom and SkippedTo.
+func (m *Marshaler) recordSkip(topicName string, partID int, from, to int64) error {
+	topic, err := m.getClaimedPartitionState(topicName, partID)
+	if err != nil {
+		return err
 	}
 
+	so := &msgSkippedOffsets{
+		msgBase:    *m.msgBase(topicName, partID),
+		FromOffset: from,
+		ToOffset:   to,
+	}
+	_, err = m.cluster.producer.Produce(MarshalTopic, int32(topic.claimPartition),
+		&proto.Message{Value: []byte(so.Encode())})
+	if err != nil {
+		return fmt.Errorf("Failed to produce skipped offsets to Kafka: %s", err)
+	}
 	return nil
 }
 
@@ -380,7 +530,10 @@ func (m *Marshaler) ReleasePartition(topicName string, partID int, offset int64)
 // long-term storage of the offset coordination system. Note: this method does not ensure
 // that this Marshal instance owns the topic/partition in question.
 func (m *Marshaler) CommitOffsets(topicName string, partID int, offset int64) error {
-	return m.offsets.Commit(topicName, int32(partID), offset)
+	span := m.startSpan(TraceCommitOffsets, topicName, partID, "offset", offset)
+	err := m.offsets.Commit(topicName, int32(partID), offset)
+	span.End(err)
+	return err
 }
 
 // ClientID returns the client ID we're using
@@ -395,39 +548,7 @@ func (m *Marshaler) GroupID() string {
 
 // PrintState will take the current state of the Marshal world and print it verbosely to the
 // logging output. This is used in the rare case where we're self-terminating or on request
-// from the user.
+// from the user. Use Snapshot to get the same information in a structured form.
 func (m *Marshaler) PrintState() {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
-
-	m.cluster.lock.RLock()
-	defer m.cluster.lock.RUnlock()
-
-	log.Infof("Marshal state dump beginning.")
-	log.Infof("")
-	log.Infof("Group ID:    %s", m.groupID)
-	log.Infof("Client ID:   %s", m.clientID)
-	log.Infof("Instance ID: %s", m.instanceID)
-	log.Infof("")
-	log.Infof("Marshal topic partitions: %d", m.cluster.partitions)
-	log.Infof("Known Kafka topics:       %d", len(m.cluster.topics))
-	log.Infof("Internal rsteps counter:  %d", atomic.LoadInt32(m.cluster.rsteps))
-	log.Infof("")
-	log.Infof("State of the world:")
-	log.Infof("")
-	for group, topicmap := range m.cluster.groups {
-		log.Infof("  GROUP: %s", group)
-		for topic, state := range topicmap {
-			log.Infof("    TOPIC: %s [on %s:%d]", topic, MarshalTopic, state.claimPartition)
-			state.PrintState()
-		}
-	}
-	log.Infof("")
-	log.Infof("Consumer states:")
-	log.Infof("")
-	for _, consumer := range m.consumers {
-		consumer.PrintState()
-	}
-	log.Infof("")
-	log.Infof("Marshal state dump complete.")
+	m.Snapshot().printState()
 }
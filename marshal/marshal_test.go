@@ -1,6 +1,7 @@
 package marshal
 
 import (
+	"encoding/json"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -160,6 +161,61 @@ func (s *MarshalSuite) TestPartitionLifecycleIntegration(c *C) {
 	}
 }
 
+func (s *MarshalSuite) TestHeartbeats(c *C) {
+	// Heartbeats for several partitions go out together, and a partition we don't own
+	// fails without affecting the others
+	c.Assert(s.m.ClaimPartition("test3", 0), Equals, true)
+	c.Assert(s.m.ClaimPartition("test3", 1), Equals, true)
+	c.Assert(s.m.cluster.waitForRsteps(2), Equals, 2)
+
+	results := s.m.heartbeats([]partitionOffset{
+		{"test3", 0, 10},
+		{"test3", 1, 20},
+		{"test3", 2, 30},
+	})
+	c.Assert(results, HasLen, 3)
+	c.Assert(results[0].err, IsNil)
+	c.Assert(results[1].err, IsNil)
+	c.Assert(results[2].err, NotNil)
+	c.Assert(results[2].committed, Equals, false)
+
+	c.Assert(s.m.cluster.waitForRsteps(4), Equals, 4)
+	c.Assert(s.m.GetPartitionClaim("test3", 0).CurrentOffset, Equals, int64(10))
+	c.Assert(s.m.GetPartitionClaim("test3", 1).CurrentOffset, Equals, int64(20))
+}
+
+func (s *MarshalSuite) TestSnapshot(c *C) {
+	c.Assert(s.m.ClaimPartition("test3", 2), Equals, true)
+	c.Assert(s.m.ClaimPartition("test3", 0), Equals, true)
+	c.Assert(s.m.cluster.waitForRsteps(2), Equals, 2)
+
+	snap := s.m.Snapshot()
+	c.Assert(snap.GroupID, Equals, "gr")
+	c.Assert(snap.ClientID, Equals, "cl")
+	c.Assert(snap.MarshalPartitions, Equals, 4)
+	c.Assert(snap.RationalizerSteps, Equals, int32(2))
+	c.Assert(snap.Groups, HasLen, 1)
+	c.Assert(snap.Groups[0].GroupID, Equals, "gr")
+	c.Assert(snap.Groups[0].Topics, HasLen, 1)
+
+	topic := snap.Groups[0].Topics[0]
+	c.Assert(topic.Topic, Equals, "test3")
+	c.Assert(topic.ClaimPartition, Equals, 2)
+	c.Assert(topic.Partitions, HasLen, 3)
+	c.Assert(topic.Partitions[0].Partition, Equals, 0)
+	c.Assert(topic.Partitions[0].Claimed, Equals, true)
+	c.Assert(topic.Partitions[0].InstanceID, Equals, s.m.instanceID)
+	c.Assert(topic.Partitions[1].Claimed, Equals, false)
+	c.Assert(topic.Partitions[2].Claimed, Equals, true)
+
+	// Round trips through JSON
+	data, err := json.Marshal(snap)
+	c.Assert(err, IsNil)
+	var decoded Snapshot
+	c.Assert(json.Unmarshal(data, &decoded), IsNil)
+	c.Assert(decoded.Groups, DeepEquals, snap.Groups)
+}
+
 func (s *MarshalSuite) TestTerminatedMarshalRemovesSelfFromCluster(c *C) {
 	// Test that terminated Marshalers remove their cluster's reference to it.
 	c.Assert(s.m.cluster.marshalers, DeepEquals, []*Marshaler{s.m})
@@ -49,6 +49,11 @@ const (
 	msgTypeReleaseGroup   msgType = 4
 	msgLengthReleaseGroup int     = msgLengthBase + 1
 	idxRGMsgExpireTime    int     = idxBaseEnd + 1
+
+	msgTypeSkippedOffsets   msgType = 5
+	msgLengthSkippedOffsets int     = msgLengthBase + 2
+	idxSOFromOffset         int     = idxBaseEnd + 1
+	idxSOToOffset           int     = idxBaseEnd + 2
 )
 
 type message interface {
@@ -136,6 +141,19 @@ func decode(inp []byte) (message, error) {
 		}
 
 		return &msgReleaseGroup{msgBase: base, MsgExpireTime: expiry}, nil
+	case "SkippedOffsets":
+		if len(parts) != msgLengthSkippedOffsets {
+			return nil, fmt.Errorf("Invalid message (so length): [%s]", string(inp))
+		}
+		from, err := strconv.ParseInt(parts[idxSOFromOffset], 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid message (so from offset): [%s]", string(inp))
+		}
+		to, err := strconv.ParseInt(parts[idxSOToOffset], 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid message (so to offset): [%s]", string(inp))
+		}
+		return &msgSkippedOffsets{msgBase: base, FromOffset: from, ToOffset: to}, nil
 	}
 	return nil, fmt.Errorf("Invalid message: [%s]", string(inp))
 }
@@ -306,3 +324,33 @@ func (m *msgReleaseGroup) Timestamp() int {
 func (m *msgReleaseGroup) Ownership() (string, string, string) {
 	return m.InstanceID, m.ClientID, m.GroupID
 }
+
+// msgSkippedOffsets is sent by the owner of a partition when its position was out of range
+// and it had to skip from FromOffset to ToOffset. Older versions of this library don't know
+// this message and will just log that they can't decode it.
+type msgSkippedOffsets struct {
+	msgBase
+	FromOffset int64
+	ToOffset   int64
+}
+
+// Encode returns a string representation of the message.
+func (m *msgSkippedOffsets) Encode() string {
+	return "SkippedOffsets/" + m.msgBase.Encode() +
+		fmt.Sprintf("/%d/%d", m.FromOffset, m.ToOffset)
+}
+
+// Type returns the type of this message.
+func (m *msgSkippedOffsets) Type() msgType {
+	return msgTypeSkippedOffsets
+}
+
+// Timestamp returns the timestamp of the message
+func (m *msgSkippedOffsets) Timestamp() int {
+	return m.Time
+}
+
+// Ownership returns InstanceID, ClientID, GroupID for message
+func (m *msgSkippedOffsets) Ownership() (string, string, string) {
+	return m.InstanceID, m.ClientID, m.GroupID
+}
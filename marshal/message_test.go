@@ -54,6 +54,13 @@ func (s *MessageSuite) TestMessageEncode(c *C) {
 		MsgExpireTime: 12,
 	}
 	c.Assert(rg.Encode(), Equals, "ReleaseGroup/4/2/ii/cl/gr//0/12")
+
+	so := msgSkippedOffsets{
+		msgBase:    base,
+		FromOffset: 10,
+		ToOffset:   20,
+	}
+	c.Assert(so.Encode(), Equals, "SkippedOffsets/4/2/ii/cl/gr/t/3/10/20")
 }
 
 func (s *MessageSuite) TestMessageDecode(c *C) {
@@ -115,4 +122,34 @@ func (s *MessageSuite) TestMessageDecode(c *C) {
 		mrg.Version != 4 {
 		c.Error("ReleaseGroup message contents invalid")
 	}
+
+	msg, err = decode([]byte("SkippedOffsets/4/2/ii/cl/gr/t/1/10/20"))
+	if msg == nil || err != nil {
+		c.Error("Expected msg, got error", err)
+	}
+	mso, ok := msg.(*msgSkippedOffsets)
+	if !ok || msg.Type() != msgTypeSkippedOffsets || mso.ClientID != "cl" || mso.GroupID != "gr" ||
+		mso.Topic != "t" || mso.PartID != 1 || mso.FromOffset != 10 || mso.ToOffset != 20 ||
+		mso.Time != 2 || mso.Version != 4 {
+		c.Error("SkippedOffsets message contents invalid")
+	}
+
+	msg, err = decode([]byte("SkippedOffsets/4/2/ii/cl/gr/t/1/10"))
+	if msg != nil || err == nil {
+		c.Error("Expected error, got msg", msg)
+	}
+}
+
+func (s *MessageSuite) TestDeadLetterKey(c *C) {
+	dl := DeadLetter{Topic: "t", Partition: 3, Offset: 12, Attempts: 5, Key: []byte("a/b")}
+	c.Assert(string(dl.encodeKey()), Equals, "t/3/12/5/a/b")
+
+	parsed, err := ParseDeadLetterKey(dl.encodeKey())
+	c.Assert(err, IsNil)
+	c.Assert(parsed, DeepEquals, dl)
+
+	_, err = ParseDeadLetterKey([]byte("a/b"))
+	c.Assert(err, NotNil)
+	_, err = ParseDeadLetterKey([]byte("t/x/12/5/"))
+	c.Assert(err, NotNil)
 }
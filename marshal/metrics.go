@@ -0,0 +1,403 @@
+/*
+ * portal - marshal
+ *
+ * a library that implements an algorithm for doing consumer coordination within Kafka, rather
+ * than using Zookeeper or another external system.
+ *
+ */
+
+package marshal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the metrics we export. Counters and histograms are recorded as things happen,
+// gauges are collected from a Snapshot of each Marshaler whenever metrics are written.
+const (
+	metricClaimAttempts     = "marshal_claim_attempts_total"
+	metricClaimFailures     = "marshal_claim_failures_total"
+	metricClaimSeconds      = "marshal_claim_seconds"
+	metricHeartbeats        = "marshal_heartbeats_total"
+	metricHeartbeatFailures = "marshal_heartbeat_failures_total"
+	metricHeartbeatSeconds  = "marshal_heartbeat_seconds"
+	metricReleases          = "marshal_releases_total"
+	metricReleaseFailures   = "marshal_release_failures_total"
+	metricDecodeErrors      = "marshal_decode_errors_total"
+	metricRationalizerSteps = "marshal_rationalizer_steps_total"
+	metricLag               = "marshal_partition_lag"
+	metricLagSeconds        = "marshal_partition_lag_seconds"
+	metricPartitionVelocity = "marshal_partition_velocity"
+	metricConsumerVelocity  = "marshal_consumer_velocity"
+	metricHeartbeatAge      = "marshal_heartbeat_age_seconds"
+	metricQueuedMessages    = "marshal_queued_messages"
+	metricQueuedBytes       = "marshal_queued_bytes"
+)
+
+// defaultBuckets are the histogram buckets, in seconds, used for the latency of our
+// requests to Kafka.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricKind int
+
+const (
+	counterMetric metricKind = iota
+	gaugeMetric
+	histogramMetric
+)
+
+func (k metricKind) String() string {
+	switch k {
+	case counterMetric:
+		return "counter"
+	case gaugeMetric:
+		return "gauge"
+	default:
+		return "histogram"
+	}
+}
+
+// metricLabels identify a series within a metric. Empty fields (and a negative partition)
+// are left out.
+type metricLabels struct {
+	group     string
+	topic     string
+	partition int
+}
+
+// groupLabels returns labels for a metric about a whole group.
+func groupLabels(group string) metricLabels {
+	return metricLabels{group: group, partition: -1}
+}
+
+// partitionLabels returns labels for a metric about a single partition.
+func partitionLabels(group, topic string, partID int) metricLabels {
+	return metricLabels{group: group, topic: topic, partition: partID}
+}
+
+// String renders the labels in the text exposition format, e.g. {group="a",topic="b"}.
+func (l metricLabels) String() string {
+	pairs := make([]string, 0, 3)
+	if l.group != "" {
+		pairs = append(pairs, "group="+quoteLabel(l.group))
+	}
+	if l.topic != "" {
+		pairs = append(pairs, "topic="+quoteLabel(l.topic))
+	}
+	if l.partition >= 0 {
+		pairs = append(pairs, "partition="+quoteLabel(strconv.Itoa(l.partition)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// quoteLabel quotes a label value, escaping backslashes, quotes and newlines.
+func quoteLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return `"` + value + `"`
+}
+
+// metricSeries is the value of a metric for one set of labels. Histograms use counts (one
+// per bucket, not cumulative), sum and count, everything else uses value.
+type metricSeries struct {
+	labels metricLabels
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metricFamily is a metric and all of its series.
+type metricFamily struct {
+	name    string
+	help    string
+	kind    metricKind
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+// metricsRegistry holds a set of metrics. It's safe for concurrent use, and a nil registry
+// ignores everything.
+type metricsRegistry struct {
+	lock     *sync.Mutex
+	families map[string]*metricFamily
+}
+
+// newMetricsRegistry returns an empty registry.
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		lock:     &sync.Mutex{},
+		families: make(map[string]*metricFamily),
+	}
+}
+
+// newClusterMetrics returns a registry with the metrics a KafkaCluster records.
+func newClusterMetrics() *metricsRegistry {
+	r := newMetricsRegistry()
+	r.define(metricClaimAttempts, counterMetric,
+		"Attempts to claim a partition.")
+	r.define(metricClaimFailures, counterMetric,
+		"Attempts to claim a partition that did not succeed.")
+	r.define(metricClaimSeconds, histogramMetric,
+		"Time taken to claim a partition, including waiting for the rationalizer.")
+	r.define(metricHeartbeats, counterMetric,
+		"Heartbeats sent for a partition.")
+	r.define(metricHeartbeatFailures, counterMetric,
+		"Heartbeats that failed, which causes the claim to be released.")
+	r.define(metricHeartbeatSeconds, histogramMetric,
+		"Time taken to produce a batch of heartbeats to the Marshal topic.")
+	r.define(metricReleases, counterMetric,
+		"Partitions released.")
+	r.define(metricReleaseFailures, counterMetric,
+		"Attempts to release a partition that did not succeed.")
+	r.define(metricDecodeErrors, counterMetric,
+		"Messages in the Marshal topic that could not be decoded.")
+	r.define(metricRationalizerSteps, counterMetric,
+		"Messages processed from the Marshal topic.")
+	return r
+}
+
+// define adds a metric to the registry. It must be called before the metric is used.
+func (r *metricsRegistry) define(name string, kind metricKind, help string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f := &metricFamily{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		series: make(map[string]*metricSeries),
+	}
+	if kind == histogramMetric {
+		f.buckets = defaultBuckets
+	}
+	r.families[name] = f
+}
+
+// getSeries returns the series of a metric for labels, creating it if needed. Must be
+// called with the lock held.
+func (r *metricsRegistry) getSeries(name string, labels metricLabels) *metricSeries {
+	f, ok := r.families[name]
+	if !ok {
+		log.Error("metric is not defined", "metric", name)
+		return &metricSeries{}
+	}
+	key := labels.String()
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: labels}
+		if f.kind == histogramMetric {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// inc increments a counter.
+func (r *metricsRegistry) inc(name string, labels metricLabels) {
+	r.add(name, labels, 1)
+}
+
+// add adds to a counter or gauge.
+func (r *metricsRegistry) add(name string, labels metricLabels, value float64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.getSeries(name, labels).value += value
+}
+
+// set sets a gauge.
+func (r *metricsRegistry) set(name string, labels metricLabels, value float64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.getSeries(name, labels).value = value
+}
+
+// observe records a value in a histogram.
+func (r *metricsRegistry) observe(name string, labels metricLabels, value float64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s := r.getSeries(name, labels)
+	for i := range s.counts {
+		if value <= r.families[name].buckets[i] {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// since records the time elapsed since start in a histogram.
+func (r *metricsRegistry) since(name string, labels metricLabels, start time.Time) {
+	r.observe(name, labels, time.Since(start).Seconds())
+}
+
+// write outputs the registry in the Prometheus text exposition format. Metrics and series
+// are sorted so the output is stable. The output is rendered before writing it to w, so a
+// slow reader doesn't hold up whoever is recording metrics.
+func (r *metricsRegistry) write(w io.Writer) error {
+	if r == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	r.render(&buf)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// render is write to a buffer, holding the lock.
+func (r *metricsRegistry) render(w *bytes.Buffer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != histogramMetric {
+				fmt.Fprintf(w, "%s%s %s\n", f.name, key, formatMetric(s.value))
+				continue
+			}
+
+			var cumulative uint64
+			for i, bound := range f.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(w, "%s_bucket%s %d\n", f.name,
+					bucketLabels(key, formatMetric(bound)), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, bucketLabels(key, "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", f.name, key, formatMetric(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", f.name, key, s.count)
+		}
+	}
+}
+
+// bucketLabels adds the le label to the rendered labels of a histogram series.
+func bucketLabels(key, le string) string {
+	if key == "" {
+		return "{le=" + quoteLabel(le) + "}"
+	}
+	return key[:len(key)-1] + ",le=" + quoteLabel(le) + "}"
+}
+
+// formatMetric formats a sample value.
+func formatMetric(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// WriteMetrics writes the metrics for this cluster and the Marshalers and consumers using
+// it to w, in the Prometheus text exposition format.
+func (c *KafkaCluster) WriteMetrics(w io.Writer) error {
+	if err := c.metrics.write(w); err != nil {
+		return err
+	}
+	return c.collectGauges().write(w)
+}
+
+// collectGauges returns a registry with the current values of our gauges, taken from a
+// Snapshot of each of our Marshalers.
+func (c *KafkaCluster) collectGauges() *metricsRegistry {
+	r := newMetricsRegistry()
+	r.define(metricLag, gaugeMetric,
+		"Messages between the current offset of a claimed partition and its end.")
+	r.define(metricLagSeconds, gaugeMetric,
+		"Estimated seconds a claimed partition is behind, from its recent velocity.")
+	r.define(metricPartitionVelocity, gaugeMetric,
+		"Messages produced to a claimed partition per heartbeat interval.")
+	r.define(metricConsumerVelocity, gaugeMetric,
+		"Messages consumed from a claimed partition per heartbeat interval.")
+	r.define(metricHeartbeatAge, gaugeMetric,
+		"Seconds since a claimed partition last heartbeated.")
+	r.define(metricQueuedMessages, gaugeMetric,
+		"Messages fetched by a consumer but not yet delivered.")
+	r.define(metricQueuedBytes, gaugeMetric,
+		"Bytes of messages fetched by a consumer but not yet delivered.")
+
+	c.lock.RLock()
+	marshalers := make([]*Marshaler, len(c.marshalers))
+	copy(marshalers, c.marshalers)
+	c.lock.RUnlock()
+
+	for _, m := range marshalers {
+		for _, consumer := range m.consumerList() {
+			snap := consumer.Snapshot()
+			if snap.Terminated {
+				continue
+			}
+			r.add(metricQueuedMessages, groupLabels(m.groupID),
+				float64(snap.Stats.QueuedMessages))
+			r.add(metricQueuedBytes, groupLabels(m.groupID),
+				float64(snap.Stats.QueuedBytes))
+			for _, cl := range snap.Claims {
+				if cl.Terminated {
+					continue
+				}
+				labels := partitionLabels(m.groupID, cl.Topic, cl.Partition)
+				r.set(metricLag, labels, float64(cl.Lag))
+				r.set(metricLagSeconds, labels, cl.SecondsBehind)
+				r.set(metricPartitionVelocity, labels, cl.PartitionVelocity)
+				r.set(metricConsumerVelocity, labels, cl.ConsumerVelocity)
+				r.set(metricHeartbeatAge, labels, float64(cl.HeartbeatAge))
+			}
+		}
+	}
+	return r
+}
+
+// NewMetricsHandler returns an http.Handler that serves the metrics of a KafkaCluster in
+// the Prometheus text exposition format.
+func NewMetricsHandler(c *KafkaCluster) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := c.WriteMetrics(w); err != nil {
+			log.Error("failed to write metrics", "cluster", c.name, "err", err)
+		}
+	})
+}
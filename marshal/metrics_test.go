@@ -0,0 +1,116 @@
+package marshal
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&MetricsSuite{})
+
+type MetricsSuite struct{}
+
+func (s *MetricsSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *MetricsSuite) TestExposition(c *C) {
+	r := newMetricsRegistry()
+	r.define("test_total", counterMetric, "A counter.")
+	r.define("test_seconds", histogramMetric, "A histogram.")
+
+	r.inc("test_total", partitionLabels("gr", "t\"1", 0))
+	r.inc("test_total", partitionLabels("gr", "t\"1", 0))
+	r.observe("test_seconds", groupLabels("gr"), 0.02)
+	r.observe("test_seconds", groupLabels("gr"), 20)
+
+	var buf bytes.Buffer
+	r.write(&buf)
+	out := buf.String()
+
+	c.Assert(strings.Contains(out, "# TYPE test_total counter\n"), Equals, true)
+	c.Assert(strings.Contains(out,
+		`test_total{group="gr",topic="t\"1",partition="0"} 2`+"\n"), Equals, true)
+	c.Assert(strings.Contains(out, "# TYPE test_seconds histogram\n"), Equals, true)
+	c.Assert(strings.Contains(out, `test_seconds_bucket{group="gr",le="0.01"} 0`+"\n"),
+		Equals, true)
+	c.Assert(strings.Contains(out, `test_seconds_bucket{group="gr",le="0.025"} 1`+"\n"),
+		Equals, true)
+	c.Assert(strings.Contains(out, `test_seconds_bucket{group="gr",le="+Inf"} 2`+"\n"),
+		Equals, true)
+	c.Assert(strings.Contains(out, `test_seconds_count{group="gr"} 2`+"\n"), Equals, true)
+
+	// A nil registry ignores everything
+	var nilRegistry *metricsRegistry
+	nilRegistry.inc("test_total", groupLabels("gr"))
+	nilRegistry.write(&buf)
+}
+
+// blockingWriter is a writer that doesn't return until it's released.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func (s *MetricsSuite) TestSlowWriter(c *C) {
+	// A stalled scrape doesn't hold up recording metrics
+	r := newMetricsRegistry()
+	r.define("test_total", counterMetric, "A counter.")
+	r.inc("test_total", groupLabels("gr"))
+
+	w := &blockingWriter{release: make(chan struct{})}
+	defer close(w.release)
+	go r.write(w)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			r.inc("test_total", groupLabels("gr"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		c.Fatal("Recording metrics blocked on a slow writer.")
+	}
+}
+
+func (s *MarshalSuite) TestMetrics(c *C) {
+	c.Assert(s.m.ClaimPartition("test1", 0), Equals, true)
+	c.Assert(s.m.cluster.waitForRsteps(1), Equals, 1)
+	c.Assert(s.m.Heartbeat("test1", 0, 5), IsNil)
+	c.Assert(s.m.Heartbeat("test2", 0, 5), NotNil)
+	_, err := s.m.releasePartition("test2", 0, 5)
+	c.Assert(err, NotNil)
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/metrics", nil)
+	c.Assert(err, IsNil)
+	NewMetricsHandler(s.m.cluster).ServeHTTP(w, r)
+	out := w.Body.String()
+
+	c.Assert(strings.Contains(out,
+		`marshal_claim_attempts_total{group="gr",topic="test1",partition="0"} 1`), Equals, true)
+	c.Assert(strings.Contains(out,
+		`marshal_heartbeats_total{group="gr",topic="test1",partition="0"} 1`), Equals, true)
+	c.Assert(strings.Contains(out,
+		`marshal_heartbeat_failures_total{group="gr",topic="test2",partition="0"} 1`),
+		Equals, true)
+	c.Assert(strings.Contains(out,
+		`marshal_release_failures_total{group="gr",topic="test2",partition="0"} 1`),
+		Equals, true)
+	c.Assert(strings.Contains(out, `marshal_claim_seconds_count{group="gr"} 1`), Equals, true)
+	c.Assert(strings.Contains(out, "# TYPE marshal_rationalizer_steps_total counter\n"),
+		Equals, true)
+	c.Assert(strings.Contains(out,
+		`marshal_rationalizer_steps_total{topic="__marshal",partition=`), Equals, true)
+}
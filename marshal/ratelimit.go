@@ -0,0 +1,99 @@
+/*
+ * portal - marshal
+ *
+ * a library that implements an algorithm for doing consumer coordination within Kafka, rather
+ * than using Zookeeper or another external system.
+ *
+ */
+
+package marshal
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimit caps how fast messages are fetched from Kafka. Either field may be left at 0 to
+// not limit on it. Short bursts of up to one second's worth are allowed.
+type RateLimit struct {
+	MessagesPerSecond float64
+	BytesPerSecond    float64
+}
+
+// rateLimiter enforces a RateLimit with a token bucket for each of its fields. A nil
+// rateLimiter doesn't limit anything.
+type rateLimiter struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+// newRateLimiter returns a rateLimiter for the given limit, or nil if it has no limits.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.MessagesPerSecond <= 0 && limit.BytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		messages: newTokenBucket(limit.MessagesPerSecond),
+		bytes:    newTokenBucket(limit.BytesPerSecond),
+	}
+}
+
+// take accounts for a message of the given size and returns how long the caller must wait
+// before handing it out.
+func (r *rateLimiter) take(size int64) time.Duration {
+	if r == nil {
+		return 0
+	}
+	wait := r.messages.take(1)
+	if bytesWait := r.bytes.take(float64(size)); bytesWait > wait {
+		wait = bytesWait
+	}
+	return wait
+}
+
+// tokenBucket is a token bucket that refills at rate tokens per second, up to one second's
+// worth. A nil tokenBucket has no limit.
+type tokenBucket struct {
+	rate float64
+
+	// lock protects the following.
+	lock   *sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   rate,
+		lock:   &sync.Mutex{},
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// take removes n tokens from the bucket. The bucket is allowed to go into debt, in which
+// case this returns how long it will take to pay it back. This lets a single message larger
+// than the bucket through eventually instead of never.
+func (b *tokenBucket) take(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,42 @@
+package marshal
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RateLimitSuite{})
+
+type RateLimitSuite struct{}
+
+func (s *RateLimitSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *RateLimitSuite) TestTokenBucket(c *C) {
+	// A second's worth can go immediately, after that we have to wait
+	b := newTokenBucket(10)
+	for i := 0; i < 10; i++ {
+		c.Assert(b.take(1), Equals, time.Duration(0))
+	}
+	wait := b.take(1)
+	c.Assert(wait > 0 && wait <= 100*time.Millisecond, Equals, true)
+
+	// Going into debt for something large makes the wait longer
+	wait = b.take(10)
+	c.Assert(wait > time.Second, Equals, true)
+
+	// nil buckets and limiters never wait
+	c.Assert(newTokenBucket(0).take(100), Equals, time.Duration(0))
+	c.Assert(newRateLimiter(RateLimit{}), IsNil)
+	c.Assert(newRateLimiter(RateLimit{}).take(100), Equals, time.Duration(0))
+}
+
+func (s *RateLimitSuite) TestRateLimiterBytes(c *C) {
+	// Whichever of the limits is furthest behind decides the wait
+	r := newRateLimiter(RateLimit{MessagesPerSecond: 1000, BytesPerSecond: 100})
+	c.Assert(r.take(100), Equals, time.Duration(0))
+	wait := r.take(100)
+	c.Assert(wait > 900*time.Millisecond && wait <= time.Second, Equals, true)
+}
@@ -9,6 +9,7 @@
 package marshal
 
 import (
+	"fmt"
 	"sync/atomic"
 	"time"
 
@@ -16,10 +17,17 @@ import (
 	"github.com/jpillora/backoff"
 )
 
+// rationalizerFields returns the fields identifying the rationalizer for a partition of the
+// Marshal topic in log messages, followed by keyvals.
+func (c *KafkaCluster) rationalizerFields(partID int, keyvals ...interface{}) []interface{} {
+	return append([]interface{}{"cluster", c.name, "topic", MarshalTopic, "partition", partID},
+		keyvals...)
+}
+
 // kafkaConsumerChannel creates a consumer that continuously attempts to consume messages from
 // Kafka for the given partition.
 func (c *KafkaCluster) kafkaConsumerChannel(partID int) <-chan message {
-	log.Debugf("[%s] rationalize[%d]: starting", c.name, partID)
+	log.Debug("rationalizer starting", c.rationalizerFields(partID)...)
 	out := make(chan message, 1000)
 	go c.consumeFromKafka(partID, out, false)
 	return out
@@ -35,7 +43,7 @@ func (c *KafkaCluster) consumeFromKafka(partID int, out chan message, startOldes
 
 	// Exit logic -- make sure downstream knows we exited.
 	defer func() {
-		log.Debugf("[%s] rationalize[%d]: terminating.", c.name, partID)
+		log.Debug("rationalizer terminating", c.rationalizerFields(partID)...)
 		close(out)
 	}()
 
@@ -47,21 +55,22 @@ func (c *KafkaCluster) consumeFromKafka(partID int, out chan message, startOldes
 		// this partition is down, so we will loop.
 		offsetFirst, err = c.broker.OffsetEarliest(MarshalTopic, int32(partID))
 		if err != nil {
-			log.Errorf("[%s] rationalize[%d]: failed to get offset: %s", c.name, partID, err)
+			log.Error("rationalizer failed to get offset", c.rationalizerFields(partID, "err", err)...)
 			continue
 		}
 		offsetNext, err = c.broker.OffsetLatest(MarshalTopic, int32(partID))
 		if err != nil {
-			log.Errorf("[%s] rationalize[%d]: failed to get offset: %s", c.name, partID, err)
+			log.Error("rationalizer failed to get offset", c.rationalizerFields(partID, "err", err)...)
 			continue
 		}
-		log.Debugf("[%s] rationalize[%d]: offsets %d to %d",
-			c.name, partID, offsetFirst, offsetNext)
+		log.Debug("rationalizer offsets",
+			c.rationalizerFields(partID, "first", offsetFirst, "next", offsetNext)...)
 
 		// TODO: Is there a case where the latest offset is X>0 but there is no data in
 		// the partition? does the offset reset to 0?
 		if offsetNext == 0 || offsetFirst == offsetNext {
 			alive = true
+			c.markRationalizerAlive(partID)
 			c.rationalizers.Done()
 		}
 		break
@@ -82,16 +91,17 @@ func (c *KafkaCluster) consumeFromKafka(partID int, out chan message, startOldes
 	if !startOldest && offsetNext-offsetFirst > 100000 {
 		checkMessageTs = true
 		consumerConf.StartOffset = offsetNext - 100000
-		log.Infof("[%s] rationalize[%d]: fast forwarding to offset %d.",
-			c.name, partID, consumerConf.StartOffset)
+		log.Info("rationalizer fast forwarding",
+			c.rationalizerFields(partID, "offset", consumerConf.StartOffset)...)
 	}
 
 	consumer, err := c.broker.Consumer(consumerConf)
 	if err != nil {
 		// Unfortunately this is a termination error, as without being able to consume this
 		// partition we can't effectively rationalize.
-		log.Errorf("[%s] rationalize[%d]: Failed to create consumer: %s", c.name, partID, err)
-		c.Terminate()
+		log.Error("rationalizer failed to create consumer",
+			c.rationalizerFields(partID, "err", err)...)
+		c.fail(fmt.Errorf("Failed to consume Marshal topic partition %d: %s", partID, err))
 		return
 	}
 
@@ -102,7 +112,7 @@ func (c *KafkaCluster) consumeFromKafka(partID int, out chan message, startOldes
 			// The internal consumer will do a number of retries. If we get an error here,
 			// we're probably in the middle of a partition handoff. We should pause so we
 			// don't hammer the cluster, but otherwise continue.
-			log.Warningf("[%s] rationalize[%d]: failed to consume: %s", c.name, partID, err)
+			log.Warn("rationalizer failed to consume", c.rationalizerFields(partID, "err", err)...)
 			time.Sleep(retry.Duration())
 			continue
 		}
@@ -116,12 +126,16 @@ func (c *KafkaCluster) consumeFromKafka(partID int, out chan message, startOldes
 			// one version of this software has a bug that writes invalid messages, it could
 			// be doing things we don't anticipate. Of course, crashing all consumers
 			// reading that partition is also bad.
-			log.Errorf("[%s] rationalize[%d]: %s", c.name, partID, err)
+			log.Error("rationalizer failed to decode message",
+				c.rationalizerFields(partID, "offset", msgb.Offset, "err", err)...)
+			c.metrics.inc(metricDecodeErrors, partitionLabels("", MarshalTopic, partID))
+			c.noteRationalizerOffset(partID, msgb.Offset)
 
 			// In the case where the first message is an invalid message, we need to
 			// to notify that we're alive now
 			if !alive {
 				alive = true
+				c.markRationalizerAlive(partID)
 				c.rationalizers.Done()
 			}
 			continue
@@ -133,16 +147,18 @@ func (c *KafkaCluster) consumeFromKafka(partID int, out chan message, startOldes
 		// TODO: This could be a binary search or something.
 		if checkMessageTs {
 			if int64(msg.Timestamp()) > time.Now().Unix()-HeartbeatInterval*2 {
-				log.Warningf("[%s] rationalize[%d]: rewinding, fast-forwarded message was too new",
-					c.name, partID)
+				log.Warn("rationalizer rewinding, fast-forwarded message was too new",
+					c.rationalizerFields(partID)...)
 				go c.consumeFromKafka(partID, out, true)
 				return // terminate self.
 			}
 			checkMessageTs = false
 		}
 
-		log.Debugf("[%s] rationalize[%d]: @%d: [%s]", c.name, partID, msgb.Offset, msg.Encode())
+		log.Debug("rationalizer message",
+			c.rationalizerFields(partID, "offset", msgb.Offset, "message", msg.Encode())...)
 		out <- msg
+		c.noteRationalizerOffset(partID, msgb.Offset)
 
 		// This is a one-time thing that fires the first time the rationalizer comes up
 		// and makes sure we actually process all of the messages.
@@ -150,14 +166,41 @@ func (c *KafkaCluster) consumeFromKafka(partID int, out chan message, startOldes
 			for len(out) > 0 {
 				time.Sleep(100 * time.Millisecond)
 			}
-			log.Infof("[%s] rationalize[%d]: reached offset %d, now alive",
-				c.name, partID, msgb.Offset)
+			log.Info("rationalizer now alive", c.rationalizerFields(partID, "offset", msgb.Offset)...)
 			alive = true
+			c.markRationalizerAlive(partID)
 			c.rationalizers.Done()
 		}
 	}
 }
 
+// noteRationalizerOffset records that the rationalizer of a Marshal topic partition has
+// read the message at the given offset.
+func (c *KafkaCluster) noteRationalizerOffset(partID int, offset int64) {
+	c.rationalizerLock.Lock()
+	defer c.rationalizerLock.Unlock()
+
+	state := c.rationalizerState[partID]
+	state.Partition = partID
+	state.Offset = offset
+	state.LastMessage = time.Now()
+	c.rationalizerState[partID] = state
+}
+
+// markRationalizerAlive records that the rationalizer of a Marshal topic partition has
+// caught up.
+func (c *KafkaCluster) markRationalizerAlive(partID int) {
+	c.rationalizerLock.Lock()
+	defer c.rationalizerLock.Unlock()
+
+	state, ok := c.rationalizerState[partID]
+	if !ok {
+		state = RationalizerSnapshot{Partition: partID, Offset: -1}
+	}
+	state.Alive = true
+	c.rationalizerState[partID] = state
+}
+
 // updateClaim is called whenever we need to adjust a claim structure.
 func (c *KafkaCluster) updateClaim(msg *msgHeartbeat) {
 	topic := c.getPartitionState(msg.GroupID, msg.Topic, msg.PartID)
@@ -185,9 +228,9 @@ func (c *KafkaCluster) releaseClaim(msg *msgReleasingPartition) {
 
 	// The partition must be claimed by the person releasing it
 	if !topic.partitions[msg.PartID].checkOwnership(msg, true) {
-		log.Warningf(
-			"[%s] ReleasePartition %s:%d from client %s that doesn't own it. Dropping.",
-			c.name, msg.Topic, msg.PartID, msg.ClientID)
+		log.Warn("dropping ReleasePartition from client that doesn't own the partition",
+			"cluster", c.name, "group", msg.GroupID, "client", msg.ClientID,
+			"topic", msg.Topic, "partition", msg.PartID)
 		return
 	}
 
@@ -198,6 +241,26 @@ func (c *KafkaCluster) releaseClaim(msg *msgReleasingPartition) {
 	topic.partitions[msg.PartID].LastRelease = int64(msg.Time)
 }
 
+// recordSkip is called whenever the owner of a partition tells us it skipped a range of
+// offsets.
+func (c *KafkaCluster) recordSkip(msg *msgSkippedOffsets) {
+	topic := c.getPartitionState(msg.GroupID, msg.Topic, msg.PartID)
+
+	topic.lock.Lock()
+	defer topic.lock.Unlock()
+
+	if !topic.partitions[msg.PartID].checkOwnership(msg, true) {
+		log.Warn("dropping SkippedOffsets from client that doesn't own the partition",
+			"cluster", c.name, "group", msg.GroupID, "client", msg.ClientID,
+			"topic", msg.Topic, "partition", msg.PartID)
+		return
+	}
+
+	topic.partitions[msg.PartID].SkippedFrom = msg.FromOffset
+	topic.partitions[msg.PartID].SkippedTo = msg.ToOffset
+	topic.partitions[msg.PartID].SkippedAt = int64(msg.Time)
+}
+
 // handleClaim is called whenever we see a ClaimPartition message.
 func (c *KafkaCluster) handleClaim(msg *msgClaimingPartition) {
 	topic := c.getPartitionState(msg.GroupID, msg.Topic, msg.PartID)
@@ -244,7 +307,7 @@ func (c *KafkaCluster) rationalize(partID int, in <-chan message) { // Might be
 	for !c.Terminated() {
 		msg, ok := <-in
 		if !ok {
-			log.Infof("[%s] rationalize[%d]: exiting, channel closed", c.name, partID)
+			log.Info("rationalizer exiting, channel closed", c.rationalizerFields(partID)...)
 			return
 		}
 
@@ -259,11 +322,14 @@ func (c *KafkaCluster) rationalize(partID int, in <-chan message) { // Might be
 			// TODO: Implement.
 		case msgTypeReleaseGroup:
 			c.releaseGroup(msg.(*msgReleaseGroup))
+		case msgTypeSkippedOffsets:
+			c.recordSkip(msg.(*msgSkippedOffsets))
 		}
 
 		// Update step counter so the test suite can wait for messages to be
 		// processed in a predictable way (rather than waiting random times)
 		atomic.AddInt32(c.rsteps, 1)
+		c.metrics.inc(metricRationalizerSteps, partitionLabels("", MarshalTopic, partID))
 	}
-	log.Infof("[%s] rationalize[%d]: exiting, Marshaler terminated", c.name, partID)
+	log.Info("rationalizer exiting, Marshaler terminated", c.rationalizerFields(partID)...)
 }
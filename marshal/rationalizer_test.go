@@ -65,6 +65,9 @@ func NewWorld() *Marshaler {
 			partitions:    1,
 			lock:          &sync.RWMutex{},
 			rationalizers: &sync.WaitGroup{},
+
+			rationalizerLock:  &sync.Mutex{},
+			rationalizerState: make(map[int]RationalizerSnapshot),
 		},
 		lock: &sync.RWMutex{},
 	}
@@ -111,6 +114,21 @@ func releasingPartition(ts int, ii, cl, gr, t string, id int, lo int64) *msgRele
 	}
 }
 
+func skippedOffsets(ts int, ii, cl, gr, t string, id int, from, to int64) *msgSkippedOffsets {
+	return &msgSkippedOffsets{
+		msgBase: msgBase{
+			Time:       ts,
+			InstanceID: ii,
+			ClientID:   cl,
+			GroupID:    gr,
+			Topic:      t,
+			PartID:     id,
+		},
+		FromOffset: from,
+		ToOffset:   to,
+	}
+}
+
 func (s *RationalizerSuite) TestClaimed(c *C) {
 	// This log, a single heartbeat at t=0, indicates that this topic/partition are claimed
 	// by the client/group given.
@@ -236,6 +254,27 @@ func (s *RationalizerSuite) TestReleaseClaim(c *C) {
 	c.Assert(s.m.GetLastPartitionClaim("test1", 0).CurrentOffset, Equals, int64(10))
 }
 
+func (s *RationalizerSuite) TestSkippedOffsets(c *C) {
+	s.out <- heartbeat(1, "ii", "cl", "gr", "test1", 0, 0)
+	c.Assert(s.m.cluster.waitForRsteps(1), Equals, 1)
+
+	// Someone that doesn't own the partition can't record a skip
+	s.out <- skippedOffsets(2, "ii", "cl-bad", "gr", "test1", 0, 5, 10)
+	c.Assert(s.m.cluster.waitForRsteps(2), Equals, 2)
+	c.Assert(s.m.GetLastPartitionClaim("test1", 0).SkippedAt, Equals, int64(0))
+
+	// The owner can, and the range outlives their later heartbeats and release
+	s.out <- skippedOffsets(3, "ii", "cl", "gr", "test1", 0, 5, 10)
+	s.out <- heartbeat(4, "ii", "cl", "gr", "test1", 0, 10)
+	s.out <- releasingPartition(5, "ii", "cl", "gr", "test1", 0, 12)
+	c.Assert(s.m.cluster.waitForRsteps(5), Equals, 5)
+
+	pc := s.m.GetLastPartitionClaim("test1", 0)
+	c.Assert(pc.SkippedFrom, Equals, int64(5))
+	c.Assert(pc.SkippedTo, Equals, int64(10))
+	c.Assert(pc.SkippedAt, Equals, int64(3))
+}
+
 func (s *RationalizerSuite) TestClaimHandoff(c *C) {
 	// This log, a single heartbeat at t=0, indicates that this topic/partition are claimed
 	// by the client/group given.
@@ -0,0 +1,200 @@
+/*
+ * portal - marshal
+ *
+ * a library that implements an algorithm for doing consumer coordination within Kafka, rather
+ * than using Zookeeper or another external system.
+ *
+ */
+
+package marshal
+
+import "time"
+
+// ReclaimInfo describes a partition that our client released and that is now unclaimed, for
+// a ReclaimPolicy to decide when we may claim it again.
+type ReclaimInfo struct {
+	Topic       string
+	Partition   int
+	LastRelease time.Time
+
+	// Releases is how many times in a row this consumer's claims on the partition have been
+	// released for failing health checks. It's reset once a claim on it is healthy again.
+	Releases int
+
+	// OtherMembers is how many other clients in our group hold a live claim, going by the
+	// Marshal topic. Clients that have nothing claimed can't be seen.
+	OtherMembers int
+}
+
+// ReclaimPolicy decides how long a consumer waits after releasing a partition before it
+// claims it again. The wait gives another member of the group the chance to take over from
+// a consumer that just proved unable to keep up. Policies must be safe for use from many
+// goroutines at once and must not block.
+type ReclaimPolicy interface {
+	ReclaimDelay(r ReclaimInfo) time.Duration
+}
+
+// CooldownReclaimPolicy waits a fixed time before reclaiming. It is the policy used unless
+// ConsumerOptions.ReclaimPolicy is set.
+type CooldownReclaimPolicy struct {
+	// Cooldown defaults to HeartbeatInterval seconds.
+	Cooldown time.Duration
+}
+
+// ReclaimDelay implements ReclaimPolicy.
+func (p CooldownReclaimPolicy) ReclaimDelay(r ReclaimInfo) time.Duration {
+	if p.Cooldown <= 0 {
+		return HeartbeatInterval * time.Second
+	}
+	return p.Cooldown
+}
+
+// BackoffReclaimPolicy waits Initial before reclaiming a partition, doubling the wait for
+// every further time in a row that the partition had to be released, up to Max.
+type BackoffReclaimPolicy struct {
+	// Initial defaults to HeartbeatInterval seconds.
+	Initial time.Duration
+	// Max defaults to 32 times Initial.
+	Max time.Duration
+}
+
+// ReclaimDelay implements ReclaimPolicy.
+func (p BackoffReclaimPolicy) ReclaimDelay(r ReclaimInfo) time.Duration {
+	initial := p.Initial
+	if initial <= 0 {
+		initial = HeartbeatInterval * time.Second
+	}
+	max := p.Max
+	if max <= 0 {
+		max = 32 * initial
+	}
+
+	delay := initial
+	for i := 1; i < r.Releases && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// AloneReclaimPolicy reclaims immediately if no other member of the group holds a claim,
+// since then there's nobody else to take over the partition. Otherwise it defers to
+// Otherwise, or to CooldownReclaimPolicy if that is nil. This lets a single consumer with a
+// stable client ID recover on its own.
+type AloneReclaimPolicy struct {
+	Otherwise ReclaimPolicy
+}
+
+// ReclaimDelay implements ReclaimPolicy.
+func (p AloneReclaimPolicy) ReclaimDelay(r ReclaimInfo) time.Duration {
+	if r.OtherMembers == 0 {
+		return 0
+	}
+	if p.Otherwise == nil {
+		return CooldownReclaimPolicy{}.ReclaimDelay(r)
+	}
+	return p.Otherwise.ReclaimDelay(r)
+}
+
+// reclaimDelay returns how long to wait after releasing a partition before claiming it
+// again, according to our ReclaimPolicy.
+func (c *Consumer) reclaimDelay(topic string, partID int, lastRelease int64) time.Duration {
+	policy := c.options.ReclaimPolicy
+	if policy == nil {
+		policy = CooldownReclaimPolicy{}
+	}
+
+	members := c.marshal.cluster.groupMembers(c.marshal.groupID)
+	delete(members, c.marshal.clientID)
+
+	return policy.ReclaimDelay(ReclaimInfo{
+		Topic:        topic,
+		Partition:    partID,
+		LastRelease:  time.Unix(lastRelease, 0),
+		Releases:     c.unhealthyReleases(topic, partID),
+		OtherMembers: len(members),
+	})
+}
+
+// unhealthyReleases returns how many times in a row a partition was released for failing
+// its health checks.
+func (c *Consumer) unhealthyReleases(topic string, partID int) int {
+	c.releasesLock.Lock()
+	defer c.releasesLock.Unlock()
+
+	return c.releases[topic][partID]
+}
+
+// noteHealth is called by our claims after each health check that passes or releases them,
+// to keep count of the releases for ReclaimInfo. It doesn't take the consumer lock, so
+// claims may call it with their own lock held.
+func (c *Consumer) noteHealth(topic string, partID int, released bool) {
+	c.releasesLock.Lock()
+	defer c.releasesLock.Unlock()
+
+	if !released {
+		delete(c.releases[topic], partID)
+		return
+	}
+	if c.releases[topic] == nil {
+		c.releases[topic] = make(map[int]int)
+	}
+	c.releases[topic][partID]++
+}
+
+// noteReleased is called by our claims when a health check releases them, to remember
+// their last status for Health. Like noteHealth, it doesn't take the consumer lock.
+func (c *Consumer) noteReleased(status ClaimStatus) {
+	c.releasesLock.Lock()
+	defer c.releasesLock.Unlock()
+
+	status.Released = true
+	if c.releasedHealth[status.Topic] == nil {
+		c.releasedHealth[status.Topic] = make(map[int]ClaimStatus)
+	}
+	c.releasedHealth[status.Topic][status.Partition] = status
+}
+
+// recentlyReleased returns the last status of the claims released by a health check in the
+// last releasedHealthTTL, and forgets older ones.
+func (c *Consumer) recentlyReleased() []ClaimStatus {
+	c.releasesLock.Lock()
+	defer c.releasesLock.Unlock()
+
+	var statuses []ClaimStatus
+	cutoff := time.Now().Add(-releasedHealthTTL)
+	for topic, partitions := range c.releasedHealth {
+		for partID, status := range partitions {
+			if status.CheckedAt.Before(cutoff) {
+				delete(partitions, partID)
+				continue
+			}
+			statuses = append(statuses, status)
+		}
+		if len(partitions) == 0 {
+			delete(c.releasedHealth, topic)
+		}
+	}
+	return statuses
+}
+
+// groupMembers returns the clients that hold a live claim in the given group.
+func (c *KafkaCluster) groupMembers(groupID string) map[string]bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	now := time.Now().Unix()
+	members := make(map[string]bool)
+	for _, topic := range c.groups[groupID] {
+		topic.lock.RLock()
+		for i := range topic.partitions {
+			if topic.partitions[i].claimed(now) {
+				members[topic.partitions[i].ClientID] = true
+			}
+		}
+		topic.lock.RUnlock()
+	}
+	return members
+}
@@ -0,0 +1,37 @@
+package marshal
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ReclaimSuite{})
+
+type ReclaimSuite struct{}
+
+func (s *ReclaimSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *ReclaimSuite) TestReclaimPolicies(c *C) {
+	r := ReclaimInfo{OtherMembers: 1}
+	c.Assert(CooldownReclaimPolicy{}.ReclaimDelay(r), Equals, HeartbeatInterval*time.Second)
+	c.Assert(CooldownReclaimPolicy{Cooldown: time.Minute}.ReclaimDelay(r), Equals, time.Minute)
+
+	// Backoff doubles with every release in a row, up to the maximum
+	p := BackoffReclaimPolicy{Initial: time.Second, Max: 5 * time.Second}
+	c.Assert(p.ReclaimDelay(r), Equals, time.Second)
+	r.Releases = 1
+	c.Assert(p.ReclaimDelay(r), Equals, time.Second)
+	r.Releases = 3
+	c.Assert(p.ReclaimDelay(r), Equals, 4*time.Second)
+	r.Releases = 10
+	c.Assert(p.ReclaimDelay(r), Equals, 5*time.Second)
+
+	// Alone we don't wait at all
+	alone := AloneReclaimPolicy{Otherwise: p}
+	c.Assert(alone.ReclaimDelay(r), Equals, 5*time.Second)
+	r.OtherMembers = 0
+	c.Assert(alone.ReclaimDelay(r), Equals, time.Duration(0))
+}
@@ -0,0 +1,412 @@
+/*
+ * portal - marshal
+ *
+ * a library that implements an algorithm for doing consumer coordination within Kafka, rather
+ * than using Zookeeper or another external system.
+ *
+ */
+
+package marshal
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot is a point in time copy of the state of a Marshaler: the world as seen through
+// the Marshal topic, and the local consumers and their claims. It can be serialized as JSON.
+type Snapshot struct {
+	Time       time.Time `json:"time"`
+	GroupID    string    `json:"group_id"`
+	ClientID   string    `json:"client_id"`
+	InstanceID string    `json:"instance_id"`
+
+	// MarshalPartitions is the number of partitions in the Marshal topic, KnownTopics the
+	// number of Kafka topics, and RationalizerSteps how many Marshal messages have been
+	// processed so far.
+	MarshalPartitions int   `json:"marshal_partitions"`
+	KnownTopics       int   `json:"known_topics"`
+	RationalizerSteps int32 `json:"rationalizer_steps"`
+
+	// PausedGroups maps paused groups to when their pause expires.
+	PausedGroups map[string]time.Time `json:"paused_groups"`
+
+	// Rationalizers is the progress of the rationalizer of each Marshal topic partition.
+	Rationalizers []RationalizerSnapshot `json:"rationalizers"`
+
+	Groups    []GroupSnapshot    `json:"groups"`
+	Consumers []ConsumerSnapshot `json:"consumers"`
+}
+
+// RationalizerSnapshot is the progress of the rationalizer of one Marshal topic partition.
+// Alive is set once it has caught up with the partition. Offset is the last message it read,
+// or -1 if it hasn't read any, and LastMessage is when it read it.
+type RationalizerSnapshot struct {
+	Partition   int       `json:"partition"`
+	Alive       bool      `json:"alive"`
+	Offset      int64     `json:"offset"`
+	LastMessage time.Time `json:"last_message"`
+}
+
+// GroupSnapshot is the state of the topics a consumer group has claims in.
+type GroupSnapshot struct {
+	GroupID string          `json:"group_id"`
+	Topics  []TopicSnapshot `json:"topics"`
+}
+
+// TopicSnapshot is the state of the claims on a topic within a group.
+type TopicSnapshot struct {
+	Topic          string              `json:"topic"`
+	ClaimPartition int                 `json:"claim_partition"`
+	Partitions     []PartitionSnapshot `json:"partitions"`
+}
+
+// PartitionSnapshot is the state of a partition claim as recorded in the Marshal topic.
+// HeartbeatAge is in seconds.
+type PartitionSnapshot struct {
+	Partition     int    `json:"partition"`
+	Claimed       bool   `json:"claimed"`
+	InstanceID    string `json:"instance_id"`
+	ClientID      string `json:"client_id"`
+	GroupID       string `json:"group_id"`
+	LastHeartbeat int64  `json:"last_heartbeat"`
+	HeartbeatAge  int64  `json:"heartbeat_age"`
+	LastRelease   int64  `json:"last_release"`
+	CurrentOffset int64  `json:"current_offset"`
+	PendingClaims int    `json:"pending_claims"`
+
+	// The last range of offsets the owner skipped, see PartitionClaim.SkippedFrom.
+	SkippedFrom int64 `json:"skipped_from,omitempty"`
+	SkippedTo   int64 `json:"skipped_to,omitempty"`
+	SkippedAt   int64 `json:"skipped_at,omitempty"`
+}
+
+// ConsumerSnapshot is the state of one of our consumers.
+type ConsumerSnapshot struct {
+	Topics     []string        `json:"topics"`
+	Paused     bool            `json:"paused"`
+	Terminated bool            `json:"terminated"`
+	Lag        int64           `json:"lag"`
+	Stats      ConsumerStats   `json:"stats"`
+	Claims     []ClaimSnapshot `json:"claims"`
+
+	// Decisions is the last claim decision for every partition, see ExplainClaims.
+	Decisions []ClaimExplanation `json:"decisions"`
+}
+
+// ClaimSnapshot is the state of a partition claimed by one of our consumers. Claimed is
+// what the Marshal topic says, Terminated whether our side of the claim has ended.
+// Lag is how many messages we are behind the end of the partition, HeartbeatAge is in
+// seconds and velocities are in messages per heartbeat.
+type ClaimSnapshot struct {
+	Topic               string           `json:"topic"`
+	Partition           int              `json:"partition"`
+	Claimed             bool             `json:"claimed"`
+	Terminated          bool             `json:"terminated"`
+	Paused              bool             `json:"paused"`
+	Offsets             PartitionOffsets `json:"offsets"`
+	Lag                 int64            `json:"lag"`
+	BeatCounter         int32            `json:"beat_counter"`
+	LastHeartbeat       int64            `json:"last_heartbeat"`
+	HeartbeatAge        int64            `json:"heartbeat_age"`
+	OutstandingMessages int              `json:"outstanding_messages"`
+	CyclesBehind        int              `json:"cycles_behind"`
+	TrackingCommitted   int              `json:"tracking_committed"`
+	TrackingOutstanding int              `json:"tracking_outstanding"`
+	PartitionVelocity   float64          `json:"partition_velocity"`
+	ConsumerVelocity    float64          `json:"consumer_velocity"`
+
+	// SecondsBehind and CatchUpSeconds are the estimates of PartitionTimeLag.
+	// CatchUpSeconds is -1 if we aren't catching up.
+	SecondsBehind  float64 `json:"seconds_behind"`
+	CatchUpSeconds float64 `json:"catch_up_seconds"`
+}
+
+// Snapshot returns the current state of this Marshaler.
+func (m *Marshaler) Snapshot() Snapshot {
+	now := time.Now()
+	snap := Snapshot{
+		Time:              now,
+		GroupID:           m.groupID,
+		ClientID:          m.clientID,
+		InstanceID:        m.instanceID,
+		MarshalPartitions: m.cluster.partitions,
+		KnownTopics:       m.cluster.numTopics(),
+		RationalizerSteps: atomic.LoadInt32(m.cluster.rsteps),
+		PausedGroups:      m.cluster.pausedGroupsAt(now),
+		Rationalizers:     m.cluster.rationalizerSnapshots(),
+		Groups:            m.cluster.groupSnapshots(now),
+	}
+
+	// Don't hold the cluster lock while looking at the consumers, as claims take it
+	// themselves.
+	for _, consumer := range m.consumerList() {
+		snap.Consumers = append(snap.Consumers, consumer.Snapshot())
+	}
+	return snap
+}
+
+// numTopics returns the number of Kafka topics we know about.
+func (c *KafkaCluster) numTopics() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.topics)
+}
+
+// pausedGroupsAt returns the groups that are paused at the given time and when their
+// pause expires.
+func (c *KafkaCluster) pausedGroupsAt(now time.Time) map[string]time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	paused := make(map[string]time.Time)
+	for group, expiry := range c.pausedGroups {
+		if now.Before(expiry) {
+			paused[group] = expiry
+		}
+	}
+	return paused
+}
+
+// rationalizerSnapshots returns the progress of each of our rationalizers.
+func (c *KafkaCluster) rationalizerSnapshots() []RationalizerSnapshot {
+	c.rationalizerLock.Lock()
+	defer c.rationalizerLock.Unlock()
+
+	snaps := make([]RationalizerSnapshot, 0, c.partitions)
+	for partID := 0; partID < c.partitions; partID++ {
+		snap, ok := c.rationalizerState[partID]
+		if !ok {
+			snap = RationalizerSnapshot{Partition: partID, Offset: -1}
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps
+}
+
+// groupSnapshots returns the world state as seen in the Marshal topic.
+func (c *KafkaCluster) groupSnapshots(now time.Time) []GroupSnapshot {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	groups := make([]GroupSnapshot, 0, len(c.groups))
+	for group, topicmap := range c.groups {
+		gs := GroupSnapshot{GroupID: group}
+		for topic, state := range topicmap {
+			gs.Topics = append(gs.Topics, state.snapshot(topic, now.Unix()))
+		}
+		sort.Slice(gs.Topics, func(i, j int) bool {
+			return gs.Topics[i].Topic < gs.Topics[j].Topic
+		})
+		groups = append(groups, gs)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].GroupID < groups[j].GroupID
+	})
+	return groups
+}
+
+// snapshot returns the state of this topic's claims.
+func (ts *topicState) snapshot(topic string, now int64) TopicSnapshot {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+
+	snap := TopicSnapshot{
+		Topic:          topic,
+		ClaimPartition: ts.claimPartition,
+		Partitions:     make([]PartitionSnapshot, 0, len(ts.partitions)),
+	}
+	for partID, claim := range ts.partitions {
+		snap.Partitions = append(snap.Partitions, PartitionSnapshot{
+			Partition:     partID,
+			Claimed:       claim.claimed(now),
+			InstanceID:    claim.InstanceID,
+			ClientID:      claim.ClientID,
+			GroupID:       claim.GroupID,
+			LastHeartbeat: claim.LastHeartbeat,
+			HeartbeatAge:  now - claim.LastHeartbeat,
+			LastRelease:   claim.LastRelease,
+			CurrentOffset: claim.CurrentOffset,
+			PendingClaims: len(claim.pendingClaims),
+			SkippedFrom:   claim.SkippedFrom,
+			SkippedTo:     claim.SkippedTo,
+			SkippedAt:     claim.SkippedAt,
+		})
+	}
+	sort.Slice(snap.Partitions, func(i, j int) bool {
+		return snap.Partitions[i].Partition < snap.Partitions[j].Partition
+	})
+	return snap
+}
+
+// Snapshot returns the current state of this consumer and its claims.
+func (c *Consumer) Snapshot() ConsumerSnapshot {
+	snap := ConsumerSnapshot{
+		Topics:     c.topics,
+		Paused:     c.Paused(),
+		Terminated: c.Terminated(),
+		Stats:      c.Stats(),
+		Decisions:  c.ExplainClaims(),
+	}
+	for _, cl := range c.claimList() {
+		cs := cl.snapshot()
+		if !cs.Terminated {
+			snap.Lag += cs.Lag
+		}
+		snap.Claims = append(snap.Claims, cs)
+	}
+	sort.Slice(snap.Claims, func(i, j int) bool {
+		if snap.Claims[i].Topic != snap.Claims[j].Topic {
+			return snap.Claims[i].Topic < snap.Claims[j].Topic
+		}
+		return snap.Claims[i].Partition < snap.Claims[j].Partition
+	})
+	return snap
+}
+
+// snapshot returns the current state of this claim.
+func (c *claim) snapshot() ClaimSnapshot {
+	// Ask the rationalizer before taking our lock
+	pc := c.marshal.GetPartitionClaim(c.topic, c.partID)
+	claimed := pc.Claimed()
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	committed := 0
+	for _, st := range c.tracking {
+		if st {
+			committed++
+		}
+	}
+
+	partitionVelocity := average(c.offsetLatestHistory[0:])
+	consumerVelocity := average(c.offsetCurrentHistory[0:])
+	timeLag := newPartitionTimeLag(c.healthInputs(consumerVelocity, partitionVelocity))
+	catchUp := timeLag.CatchUp.Seconds()
+	if !timeLag.CatchingUp {
+		catchUp = -1
+	}
+
+	return ClaimSnapshot{
+		Topic:               c.topic,
+		Partition:           c.partID,
+		Claimed:             claimed,
+		Terminated:          c.Terminated(),
+		Paused:              c.Paused(),
+		Offsets:             c.offsets,
+		Lag:                 timeLag.Lag,
+		BeatCounter:         c.beatCounter,
+		LastHeartbeat:       c.lastHeartbeat,
+		HeartbeatAge:        time.Now().Unix() - c.lastHeartbeat,
+		OutstandingMessages: c.outstandingMessages,
+		CyclesBehind:        c.cyclesBehind,
+		TrackingCommitted:   committed,
+		TrackingOutstanding: len(c.tracking) - committed,
+		PartitionVelocity:   partitionVelocity,
+		ConsumerVelocity:    consumerVelocity,
+		SecondsBehind:       timeLag.Behind.Seconds(),
+		CatchUpSeconds:      catchUp,
+	}
+}
+
+// printState logs a Snapshot, see Marshaler.PrintState.
+func (s Snapshot) printState() {
+	log.Infof("Marshal state dump beginning.")
+	log.Infof("")
+	log.Infof("Group ID:    %s", s.GroupID)
+	log.Infof("Client ID:   %s", s.ClientID)
+	log.Infof("Instance ID: %s", s.InstanceID)
+	log.Infof("")
+	log.Infof("Marshal topic partitions: %d", s.MarshalPartitions)
+	log.Infof("Known Kafka topics:       %d", s.KnownTopics)
+	log.Infof("Internal rsteps counter:  %d", s.RationalizerSteps)
+	for group, expiry := range s.PausedGroups {
+		log.Infof("Paused group:             %s (until %s)", group, expiry)
+	}
+	for _, r := range s.Rationalizers {
+		log.Infof("Rationalizer %3d:         alive=%t offset=%d last=%s",
+			r.Partition, r.Alive, r.Offset, r.LastMessage.Format(time.RFC3339))
+	}
+	log.Infof("")
+	log.Infof("State of the world:")
+	log.Infof("")
+	for _, group := range s.Groups {
+		log.Infof("  GROUP: %s", group.GroupID)
+		for _, topic := range group.Topics {
+			log.Infof("    TOPIC: %s [on %s:%d]", topic.Topic, MarshalTopic, topic.ClaimPartition)
+			topic.printState()
+		}
+	}
+	log.Infof("")
+	log.Infof("Consumer states:")
+	log.Infof("")
+	for _, consumer := range s.Consumers {
+		consumer.printState()
+	}
+	log.Infof("")
+	log.Infof("Marshal state dump complete.")
+}
+
+// printState logs a TopicSnapshot, see topicState.PrintState.
+func (s TopicSnapshot) printState() {
+	for _, p := range s.Partitions {
+		state := "CLMD"
+		if !p.Claimed {
+			state = "----"
+		}
+		log.Infof("      * %2d [%s]: GPID %s | CLID %s | LHB %d (%d) | LOF %d | PCL %d",
+			p.Partition, state, p.GroupID, p.ClientID, p.LastHeartbeat,
+			p.HeartbeatAge, p.CurrentOffset, p.PendingClaims)
+	}
+}
+
+// printState logs a ConsumerSnapshot, see Consumer.PrintState.
+func (s ConsumerSnapshot) printState() {
+	log.Infof("  CONSUMER: %d messages in queue (%d bytes)",
+		s.Stats.QueuedMessages, s.Stats.QueuedBytes)
+	for _, topic := range s.Topics {
+		log.Infof("    TOPIC: %s", topic)
+		for _, claim := range s.Claims {
+			if claim.Topic == topic {
+				claim.printState()
+			}
+		}
+		for _, exp := range s.Decisions {
+			if exp.Topic != topic || exp.Decision == DecisionHeld ||
+				exp.Decision == DecisionClaimed {
+				continue
+			}
+			log.Infof("      - %2d [%s] %s", exp.Partition, exp.Decision, exp.Reason)
+		}
+	}
+}
+
+// printState logs a ClaimSnapshot, see claim.PrintState.
+func (s ClaimSnapshot) printState() {
+	// "Claimed" status is from Marshal rationalizer, and "Terminated" status is from
+	// the local claim object (indicates we've exited somehow)
+	state := "----"
+	if s.Claimed {
+		if s.Terminated {
+			state = "CL+T"
+		} else {
+			state = "CLMD"
+		}
+	} else if s.Terminated {
+		state = "TERM"
+	}
+
+	log.Infof("      * %2d [%s]: offsets %d <= %d <= %d | %d",
+		s.Partition, state, s.Offsets.Earliest, s.Offsets.Current,
+		s.Offsets.Latest, s.Offsets.Committed)
+	log.Infof("                   BC %d | LHB %d (%d) | OM %d | CB %d",
+		s.BeatCounter, s.LastHeartbeat, s.HeartbeatAge,
+		s.OutstandingMessages, s.CyclesBehind)
+	log.Infof("                   TRACK COMMITTED %d | TRACK OUTSTANDING %d",
+		s.TrackingCommitted, s.TrackingOutstanding)
+	log.Infof("                   PV %0.2f | CV %0.2f | BEHIND %0.0fs | CATCH UP %0.0fs",
+		s.PartitionVelocity, s.ConsumerVelocity, s.SecondsBehind, s.CatchUpSeconds)
+}
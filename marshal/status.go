@@ -0,0 +1,263 @@
+/*
+ * portal - marshal
+ *
+ * a library that implements an algorithm for doing consumer coordination within Kafka, rather
+ * than using Zookeeper or another external system.
+ *
+ */
+
+package marshal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// StatusHandler is an http.Handler that reports the state of a Marshaler and its consumers
+// and lets operators control them. Mount it on an admin port, for example with:
+//
+//	mux.Handle("/marshal/", http.StripPrefix("/marshal", marshal.NewStatusHandler(m, token)))
+//
+// The following endpoints are served, relative to where the handler is mounted:
+//
+//	GET  /              the full Snapshot of the Marshaler
+//	GET  /consumers     per consumer claims, lag and queue stats
+//	GET  /groups        the state of the world as seen in the Marshal topic
+//	GET  /paused        paused groups and when their pause expires
+//	GET  /rationalizer  how far the rationalizer of each Marshal partition has progressed
+//	GET  /health        per consumer Health, with status 503 if any has terminated
+//	POST /flush         flush offsets for all consumers
+//	POST /release       release a partition, given topic and partition parameters
+//	POST /pause         pause all consumers, or a partition given topic and partition
+//	POST /resume        undo /pause
+//
+// The POST endpoints are disabled unless an auth token is given, in which case requests
+// must carry the header "Authorization: Bearer <token>".
+type StatusHandler struct {
+	// authToken authenticates control requests. It never changes after construction.
+	authToken string
+
+	marshal *Marshaler
+	mux     *http.ServeMux
+}
+
+// rationalizerStatus is served by /rationalizer.
+type rationalizerStatus struct {
+	MarshalPartitions int                    `json:"marshal_partitions"`
+	RationalizerSteps int32                  `json:"rationalizer_steps"`
+	Partitions        []RationalizerSnapshot `json:"partitions"`
+}
+
+// NewStatusHandler returns a StatusHandler for the given Marshaler. Control requests must
+// carry authToken; if it's empty, they are disabled.
+func NewStatusHandler(m *Marshaler, authToken string) *StatusHandler {
+	h := &StatusHandler{
+		authToken: authToken,
+		marshal:   m,
+		mux:       http.NewServeMux(),
+	}
+
+	snapshot := h.get(func() interface{} {
+		return m.Snapshot()
+	})
+	h.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// The root pattern matches everything, don't serve the snapshot for typos
+		if r.URL.Path != "/" {
+			writeStatusError(w, http.StatusNotFound, "not found")
+			return
+		}
+		snapshot(w, r)
+	})
+	h.mux.HandleFunc("/consumers", h.get(func() interface{} {
+		consumers := make([]ConsumerSnapshot, 0)
+		for _, consumer := range m.consumerList() {
+			consumers = append(consumers, consumer.Snapshot())
+		}
+		return consumers
+	}))
+	h.mux.HandleFunc("/groups", h.get(func() interface{} {
+		return m.cluster.groupSnapshots(time.Now())
+	}))
+	h.mux.HandleFunc("/paused", h.get(func() interface{} {
+		return m.cluster.pausedGroupsAt(time.Now())
+	}))
+	h.mux.HandleFunc("/rationalizer", h.get(func() interface{} {
+		return rationalizerStatus{
+			MarshalPartitions: m.cluster.partitions,
+			RationalizerSteps: atomic.LoadInt32(m.cluster.rsteps),
+			Partitions:        m.cluster.rationalizerSnapshots(),
+		}
+	}))
+
+	h.mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			writeStatusError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		code := http.StatusOK
+		consumers := make([]ConsumerHealth, 0)
+		for _, consumer := range m.consumerList() {
+			health := consumer.Health()
+			if health.Status == StatusUnhealthy {
+				code = http.StatusServiceUnavailable
+			}
+			consumers = append(consumers, health)
+		}
+		writeStatusJSON(w, code, consumers)
+	})
+
+	h.mux.HandleFunc("/flush", h.post(func(r *http.Request) error {
+		failed := 0
+		for _, consumer := range m.consumerList() {
+			if err := consumer.Flush(); err != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d consumers failed to flush", failed)
+		}
+		return nil
+	}))
+	h.mux.HandleFunc("/release", h.post(func(r *http.Request) error {
+		topic, partID, err := partitionParams(r)
+		if err != nil {
+			return err
+		}
+		if topic == "" {
+			return errors.New("topic and partition are required")
+		}
+		return h.eachOwner(topic, partID, (*Consumer).ReleasePartition)
+	}))
+	h.mux.HandleFunc("/pause", h.post(func(r *http.Request) error {
+		topic, partID, err := partitionParams(r)
+		if err != nil {
+			return err
+		}
+		if topic != "" {
+			return h.eachOwner(topic, partID, (*Consumer).PausePartition)
+		}
+		for _, consumer := range m.consumerList() {
+			consumer.Pause()
+		}
+		return nil
+	}))
+	h.mux.HandleFunc("/resume", h.post(func(r *http.Request) error {
+		topic, partID, err := partitionParams(r)
+		if err != nil {
+			return err
+		}
+		if topic != "" {
+			return h.eachOwner(topic, partID, (*Consumer).ResumePartition)
+		}
+		for _, consumer := range m.consumerList() {
+			consumer.Resume()
+		}
+		return nil
+	}))
+
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// get returns a handler that serves the result of state as JSON.
+func (h *StatusHandler) get(state func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			writeStatusError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeStatusJSON(w, http.StatusOK, state())
+	}
+}
+
+// post returns a handler that authenticates the request and then runs action.
+func (h *StatusHandler) post(action func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeStatusError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !h.authorized(r) {
+			writeStatusError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		if err := action(r); err != nil {
+			writeStatusError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Info("status handler control request", "method", r.Method, "url", r.URL,
+			"remote", r.RemoteAddr)
+		writeStatusJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// authorized returns whether a control request carries our token.
+func (h *StatusHandler) authorized(r *http.Request) bool {
+	if h.authToken == "" {
+		return false
+	}
+	expected := "Bearer " + h.authToken
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")),
+		[]byte(expected)) == 1
+}
+
+// eachOwner calls op on the consumers that have claimed a partition. It's an error if none
+// of our consumers have.
+func (h *StatusHandler) eachOwner(topic string, partID int,
+	op func(*Consumer, string, int) error) error {
+
+	found := false
+	for _, consumer := range h.marshal.consumerList() {
+		if _, err := consumer.getActiveClaim(topic, partID); err != nil {
+			continue
+		}
+		found = true
+		if err := op(consumer, topic, partID); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("partition %s:%d is not claimed by any consumer", topic, partID)
+	}
+	return nil
+}
+
+// partitionParams extracts the optional topic and partition parameters of a request.
+func partitionParams(r *http.Request) (string, int, error) {
+	topic := r.FormValue("topic")
+	partition := r.FormValue("partition")
+	if topic == "" && partition == "" {
+		return "", 0, nil
+	}
+	if topic == "" || partition == "" {
+		return "", 0, errors.New("topic and partition must be given together")
+	}
+	partID, err := strconv.Atoi(partition)
+	if err != nil || partID < 0 {
+		return "", 0, fmt.Errorf("invalid partition: %s", partition)
+	}
+	return topic, partID, nil
+}
+
+func writeStatusJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(v); err != nil {
+		log.Error("status handler failed to write response", "err", err)
+	}
+}
+
+func writeStatusError(w http.ResponseWriter, code int, msg string) {
+	writeStatusJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,85 @@
+package marshal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConsumerSuite) TestStatusHandler(c *C) {
+	s.m.addNewConsumer(s.cn)
+	c.Assert(s.cn.tryClaimPartition("test3", 0), Equals, true)
+	c.Assert(s.kc.waitForRsteps(2), Equals, 2)
+
+	h := NewStatusHandler(s.m, "")
+	serve := func(method, path, token string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, path, nil)
+		c.Assert(err, IsNil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("GET", "/consumers", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var consumers []ConsumerSnapshot
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &consumers), IsNil)
+	c.Assert(consumers, HasLen, 1)
+	c.Assert(consumers[0].Claims, HasLen, 1)
+	c.Assert(consumers[0].Claims[0].Partition, Equals, 0)
+
+	w = serve("GET", "/groups", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var groups []GroupSnapshot
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &groups), IsNil)
+	found := false
+	for _, group := range groups {
+		found = found || group.GroupID == s.gr
+	}
+	c.Assert(found, Equals, true)
+
+	// Every rationalizer is alive, and the one that saw our claim has read something
+	w = serve("GET", "/rationalizer", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var rationalizers rationalizerStatus
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &rationalizers), IsNil)
+	c.Assert(rationalizers.Partitions, HasLen, rationalizers.MarshalPartitions)
+	read := false
+	for _, r := range rationalizers.Partitions {
+		c.Assert(r.Alive, Equals, true)
+		read = read || r.Offset >= 0
+	}
+	c.Assert(read, Equals, true)
+
+	c.Assert(serve("GET", "/", "").Code, Equals, http.StatusOK)
+	c.Assert(serve("GET", "/bogus", "").Code, Equals, http.StatusNotFound)
+
+	// Control requests need the token, and are disabled without one
+	c.Assert(serve("POST", "/pause", "").Code, Equals, http.StatusForbidden)
+	c.Assert(serve("POST", "/pause", "secret").Code, Equals, http.StatusForbidden)
+	h = NewStatusHandler(s.m, "secret")
+	c.Assert(serve("POST", "/pause", "wrong").Code, Equals, http.StatusForbidden)
+	c.Assert(serve("GET", "/pause", "secret").Code, Equals, http.StatusMethodNotAllowed)
+
+	c.Assert(serve("POST", "/pause", "secret").Code, Equals, http.StatusOK)
+	c.Assert(s.cn.Paused(), Equals, true)
+	c.Assert(serve("POST", "/resume", "secret").Code, Equals, http.StatusOK)
+	c.Assert(s.cn.Paused(), Equals, false)
+
+	c.Assert(serve("POST", "/pause?topic=test3&partition=0", "secret").Code,
+		Equals, http.StatusOK)
+	c.Assert(s.cn.claims["test3"][0].Paused(), Equals, true)
+	c.Assert(serve("POST", "/pause?topic=test3&partition=1", "secret").Code,
+		Equals, http.StatusBadRequest)
+
+	c.Assert(serve("POST", "/release", "secret").Code, Equals, http.StatusBadRequest)
+	c.Assert(serve("POST", "/release?topic=test3&partition=0", "secret").Code,
+		Equals, http.StatusOK)
+	c.Assert(s.kc.waitForRsteps(3), Equals, 3)
+	c.Assert(s.m.GetPartitionClaim("test3", 0).LastHeartbeat, Equals, int64(0))
+}
@@ -26,19 +26,7 @@ type topicState struct {
 
 // PrintState causes us to log the state of this topic's claims.
 func (ts *topicState) PrintState() {
-	ts.lock.RLock()
-	defer ts.lock.RUnlock()
-
-	now := time.Now().Unix()
-	for partID, claim := range ts.partitions {
-		state := "CLMD"
-		if !claim.claimed(now) {
-			state = "----"
-		}
-		log.Infof("      * %2d [%s]: GPID %s | CLID %s | LHB %d (%d) | LOF %d | PCL %d",
-			partID, state, claim.GroupID, claim.ClientID, claim.LastHeartbeat,
-			now-claim.LastHeartbeat, claim.CurrentOffset, len(claim.pendingClaims))
-	}
+	ts.snapshot("", time.Now().Unix()).printState()
 }
 
 // PartitionOffsets is a record of offsets for a given partition. Contains information
@@ -84,6 +72,12 @@ type PartitionClaim struct {
 	LastHeartbeat int64
 	CurrentOffset int64
 
+	// The last range of offsets the owner had to skip because its position was out of range,
+	// and when. SkippedAt is 0 if nothing has been skipped.
+	SkippedFrom int64
+	SkippedTo   int64
+	SkippedAt   int64
+
 	// Used internally when someone is waiting on this partition to be claimed.
 	pendingClaims []chan struct{}
 }
@@ -0,0 +1,65 @@
+/*
+ * portal - marshal
+ *
+ * a library that implements an algorithm for doing consumer coordination within Kafka, rather
+ * than using Zookeeper or another external system.
+ *
+ */
+
+package marshal
+
+// Names of the operations passed to Tracer.StartSpan.
+const (
+	// TraceClaimPartition covers producing a claim and waiting for the rationalizer to
+	// decide it. The "produced" event marks the end of the produce.
+	TraceClaimPartition = "marshal.ClaimPartition"
+	// TraceHeartbeat covers heartbeating one or more partitions.
+	TraceHeartbeat = "marshal.Heartbeat"
+	// TraceReleasePartition covers committing the final offset and producing a release.
+	TraceReleasePartition = "marshal.ReleasePartition"
+	// TraceGetPartitionOffsets covers fetching a partition's offsets from Kafka.
+	TraceGetPartitionOffsets = "marshal.GetPartitionOffsets"
+	// TraceCommitOffsets covers committing an offset to Kafka's offset storage.
+	TraceCommitOffsets = "marshal.CommitOffsets"
+	// TraceSetConsumerGroupPosition covers an Admin resetting a group's offsets. Its phases
+	// are marked by the "group_paused" and "partitions_claimed" events.
+	TraceSetConsumerGroupPosition = "marshal.SetConsumerGroupPosition"
+)
+
+// Tracer is told when Marshal starts one of its coordination operations, so they can be
+// bridged into a tracing system. Set it with MarshalOptions.Tracer. It's called from many
+// goroutines at once, and shouldn't block.
+type Tracer interface {
+	// StartSpan is called when an operation starts. keyvals are attributes of the operation,
+	// such as the group, client, topic and partition, given as alternating keys and values.
+	StartSpan(operation string, keyvals ...interface{}) Span
+}
+
+// Span is a single operation being traced.
+type Span interface {
+	// Event records that the operation has reached a phase.
+	Event(name string, keyvals ...interface{})
+	// End is called once when the operation finishes, with the error it failed with or nil.
+	End(err error)
+}
+
+// noopSpan is used when there is no Tracer.
+type noopSpan struct{}
+
+func (noopSpan) Event(name string, keyvals ...interface{}) {}
+func (noopSpan) End(err error)                             {}
+
+// startSpan starts tracing an operation with our Tracer, if we have one.
+func (c *KafkaCluster) startSpan(operation string, keyvals ...interface{}) Span {
+	if c.options.Tracer == nil {
+		return noopSpan{}
+	}
+	return c.options.Tracer.StartSpan(operation, keyvals...)
+}
+
+// startSpan starts tracing an operation on a partition.
+func (m *Marshaler) startSpan(operation, topicName string, partID int,
+	keyvals ...interface{}) Span {
+
+	return m.cluster.startSpan(operation, partitionFields(m, topicName, partID, keyvals...)...)
+}
@@ -0,0 +1,84 @@
+package marshal
+
+import (
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+// recordingTracer remembers the spans it has been asked to start.
+type recordingTracer struct {
+	lock  *sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	operation string
+	keyvals   []interface{}
+	events    []string
+	ended     bool
+	err       error
+}
+
+func (t *recordingTracer) StartSpan(operation string, keyvals ...interface{}) Span {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	span := &recordedSpan{operation: operation, keyvals: keyvals}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func (s *recordedSpan) Event(name string, keyvals ...interface{}) {
+	s.events = append(s.events, name)
+}
+
+func (s *recordedSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+// find returns the spans for an operation.
+func (t *recordingTracer) find(operation string) []*recordedSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var spans []*recordedSpan
+	for _, span := range t.spans {
+		if span.operation == operation {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func (s *MarshalSuite) TestTracer(c *C) {
+	tracer := &recordingTracer{lock: &sync.Mutex{}}
+	s.m.cluster.options.Tracer = tracer
+
+	c.Assert(s.m.ClaimPartition("test1", 0), Equals, true)
+	c.Assert(s.m.Heartbeat("test1", 0, 5), IsNil)
+	c.Assert(s.m.Heartbeat("test2", 0, 5), NotNil)
+	_, err := s.m.GetPartitionOffsets("test1", 0)
+	c.Assert(err, IsNil)
+	c.Assert(s.m.ReleasePartition("test1", 0, 5), IsNil)
+
+	claims := tracer.find(TraceClaimPartition)
+	c.Assert(claims, HasLen, 1)
+	c.Assert(claims[0].ended, Equals, true)
+	c.Assert(claims[0].err, IsNil)
+	c.Assert(claims[0].events, DeepEquals, []string{"produced"})
+	c.Assert(claims[0].keyvals, DeepEquals, []interface{}{
+		"group", "gr", "client", "cl", "topic", "test1", "partition", 0})
+
+	beats := tracer.find(TraceHeartbeat)
+	c.Assert(beats, HasLen, 2)
+	c.Assert(beats[0].err, IsNil)
+	c.Assert(beats[1].err, NotNil)
+
+	c.Assert(tracer.find(TraceGetPartitionOffsets), HasLen, 1)
+	c.Assert(tracer.find(TraceReleasePartition), HasLen, 1)
+	c.Assert(tracer.find(TraceReleasePartition)[0].err, IsNil)
+	// Heartbeats and the release commit offsets
+	c.Assert(len(tracer.find(TraceCommitOffsets)) >= 2, Equals, true)
+}